@@ -0,0 +1,95 @@
+// Package checksum はIP、TCPで使うインターネットチェックサム (RFC1071) を計算する。
+// 64bitずつ足し、ヘッダとペイロードのように分かれたbyte列をつなげずに計算でき、
+// 一部のフィールドだけを書き換えたときはRFC1624の差分更新ができる
+package checksum
+
+import (
+	"encoding/binary"
+	"math/bits"
+	"net/netip"
+)
+
+// Add はbを先頭が偶数byte目にあるものとして1の補数和でsumに足す。
+// 長さが奇数なら最後に0を補う。返す値は折り返す前のものなのでFoldで16bitにする
+func Add(sum uint64, b []byte) uint64 {
+	var carry uint64
+	// 2^16 ≡ 1 (mod 2^16-1) なので16bitごとの和は64bitごとに足して折り返しても変わらない
+	for len(b) >= 32 {
+		sum, carry = bits.Add64(sum, binary.BigEndian.Uint64(b), carry)
+		sum, carry = bits.Add64(sum, binary.BigEndian.Uint64(b[8:]), carry)
+		sum, carry = bits.Add64(sum, binary.BigEndian.Uint64(b[16:]), carry)
+		sum, carry = bits.Add64(sum, binary.BigEndian.Uint64(b[24:]), carry)
+		b = b[32:]
+	}
+	for len(b) >= 8 {
+		sum, carry = bits.Add64(sum, binary.BigEndian.Uint64(b), carry)
+		b = b[8:]
+	}
+	if len(b) >= 4 {
+		sum, carry = bits.Add64(sum, uint64(binary.BigEndian.Uint32(b)), carry)
+		b = b[4:]
+	}
+	if len(b) >= 2 {
+		sum, carry = bits.Add64(sum, uint64(binary.BigEndian.Uint16(b)), carry)
+		b = b[2:]
+	}
+	if len(b) == 1 {
+		sum, carry = bits.Add64(sum, uint64(b[0])<<8, carry)
+	}
+	// あふれた桁は下に足す (end-around carry)
+	sum, carry = bits.Add64(sum, 0, carry)
+	return sum + carry
+}
+
+// Fold はあふれた桁を下に足して16bitにする
+func Fold(sum uint64) uint16 {
+	sum = (sum >> 32) + (sum & 0xffffffff)
+	sum = (sum >> 32) + (sum & 0xffffffff)
+	sum = (sum >> 16) + (sum & 0xffff)
+	sum = (sum >> 16) + (sum & 0xffff)
+	return uint16(sum)
+}
+
+// Checksum はinitialにbufsを順につなげたものとして足し、チェックサムにする。
+// 途中のbyte列の長さが奇数でもつなげたときと同じ値になる
+func Checksum(initial uint64, bufs ...[]byte) uint16 {
+	sum := uint64(Fold(initial))
+	odd := false
+	for _, b := range bufs {
+		s := Fold(Add(0, b))
+		// 奇数byte目から始まる列は上下のbyteが入れ替わる (RFC1071 2.(B))
+		if odd {
+			s = bits.ReverseBytes16(s)
+		}
+		sum += uint64(s)
+		odd = odd != (len(b)%2 == 1)
+	}
+	return ^Fold(sum)
+}
+
+// Update16 は16bitのフィールドがoldからnewに変わったときのチェックサムを計算し直す。
+// HC' = ~(~HC + ~m + m') (RFC1624 3)
+func Update16(checksum, old, new uint16) uint16 {
+	sum := uint64(^checksum) + uint64(^old) + uint64(new)
+	return ^Fold(sum)
+}
+
+// Update32 は32bitのフィールドがoldからnewに変わったときのチェックサムを計算し直す
+func Update32(checksum uint16, old, new uint32) uint16 {
+	checksum = Update16(checksum, uint16(old>>16), uint16(new>>16))
+	return Update16(checksum, uint16(old), uint16(new))
+}
+
+// PseudoHeader はTCPやUDPのチェックサムに含める疑似ヘッダの和を返す。
+// IPv4は12byte (RFC9293 3.1)、IPv6は40byte (RFC8200 8.1) のものを足す
+func PseudoHeader(src, dst netip.Addr, protocol uint8, length int) uint64 {
+	var sum uint64
+	if src.Is4() {
+		s, d := src.As4(), dst.As4()
+		sum = Add(Add(0, s[:]), d[:])
+	} else {
+		s, d := src.As16(), dst.As16()
+		sum = Add(Add(0, s[:]), d[:])
+	}
+	return sum + uint64(length>>16) + uint64(length&0xffff) + uint64(protocol)
+}
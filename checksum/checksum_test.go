@@ -0,0 +1,99 @@
+package checksum
+
+import (
+	"encoding/binary"
+	"math/rand"
+	"net/netip"
+	"testing"
+)
+
+// naive は16bitずつ32bitで足して折り返すだけの素朴な実装 (RFC1071 4.1)
+func naive(b []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(b); i += 2 {
+		sum += uint32(b[i])<<8 | uint32(b[i+1])
+	}
+	if len(b)%2 == 1 {
+		sum += uint32(b[len(b)-1]) << 8
+	}
+	for sum>>16 != 0 {
+		sum = sum&0xffff + sum>>16
+	}
+	return ^uint16(sum)
+}
+
+// randomBytes はrで決めた長さのbyte列を返す。ときどき桁あふれの多いすべて0xffの列にする
+func randomBytes(r *rand.Rand, i int) []byte {
+	b := make([]byte, r.Intn(3000))
+	r.Read(b)
+	if i%7 == 0 {
+		for j := range b {
+			b[j] = 0xff
+		}
+	}
+	return b
+}
+
+func TestChecksum(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 3000; i++ {
+		b := randomBytes(r, i)
+		want := naive(b)
+		if got := Checksum(0, b); got != want {
+			t.Fatalf("%d bytes : got %#04x, want %#04x", len(b), got, want)
+		}
+		// 奇数byteで切ってもつなげたときと同じになる
+		x := r.Intn(len(b) + 1)
+		y := x + r.Intn(len(b)-x+1)
+		if got := Checksum(0, b[:x], b[x:y], b[y:]); got != want {
+			t.Fatalf("%d bytes split at %d and %d : got %#04x, want %#04x", len(b), x, y, got, want)
+		}
+	}
+}
+
+func TestUpdate(t *testing.T) {
+	r := rand.New(rand.NewSource(2))
+	for i := 0; i < 3000; i++ {
+		b := randomBytes(r, i)
+		if len(b) < 8 {
+			continue
+		}
+		sum := naive(b)
+		old16, old32 := binary.BigEndian.Uint16(b[0:2]), binary.BigEndian.Uint32(b[2:6])
+		new16, new32 := uint16(r.Uint32()), r.Uint32()
+		binary.BigEndian.PutUint16(b[0:2], new16)
+		binary.BigEndian.PutUint32(b[2:6], new32)
+		got := Update32(Update16(sum, old16, new16), old32, new32)
+		// 0と0xffffはどちらも1の補数の0なので区別しない
+		want := naive(b)
+		if got != want && !(got == 0 && want == 0xffff) && !(got == 0xffff && want == 0) {
+			t.Fatalf("%d bytes : got %#04x, want %#04x", len(b), got, want)
+		}
+	}
+}
+
+func TestPseudoHeader(t *testing.T) {
+	for _, tc := range []struct {
+		src, dst string
+		pseudo   func(src, dst netip.Addr, length int) []byte
+	}{
+		// 送信元、宛先、0、プロトコル、16bitの長さ (RFC9293 3.1)
+		{"192.0.2.1", "192.0.2.2", func(src, dst netip.Addr, length int) []byte {
+			b := append(src.AsSlice(), dst.AsSlice()...)
+			b = append(b, 0, 6)
+			return binary.BigEndian.AppendUint16(b, uint16(length))
+		}},
+		// 送信元、宛先、32bitの長さ、3byteの0とNext Header (RFC8200 8.1)
+		{"2001:db8::1", "2001:db8::2", func(src, dst netip.Addr, length int) []byte {
+			b := append(src.AsSlice(), dst.AsSlice()...)
+			b = binary.BigEndian.AppendUint32(b, uint32(length))
+			return append(b, 0, 0, 0, 6)
+		}},
+	} {
+		src, dst := netip.MustParseAddr(tc.src), netip.MustParseAddr(tc.dst)
+		got := Checksum(PseudoHeader(src, dst, 6, 1234))
+		if want := naive(tc.pseudo(src, dst, 1234)); got != want {
+			t.Errorf("%s -> %s : got %#04x, want %#04x", src, dst, got, want)
+		}
+	}
+}
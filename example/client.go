@@ -12,7 +12,7 @@ func main() {
 	}
 
 	//for i := 0; i < 3; i++ {
-	conn, _, err = conn.Write(rfc9401.CreateHttpGet("127.0.0.1", 18080))
+	_, err = conn.Write(rfc9401.CreateHttpGet("127.0.0.1", 18080))
 	if err != nil {
 		log.Fatalf("Write error : %v", err)
 	}
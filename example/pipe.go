@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/netip"
+	"rfc9401"
+)
+
+// root権限なしでプロセス内の2つのStackをつないでHTTPをやりとりする
+func main() {
+	clientAddr := netip.MustParseAddr("192.0.2.1")
+	serverAddr := netip.MustParseAddr("192.0.2.2")
+	clientIO, serverIO := rfc9401.Pipe(clientAddr, serverAddr)
+
+	server := rfc9401.NewStack(serverIO)
+	defer server.Close()
+	client := rfc9401.NewStack(clientIO)
+	defer client.Close()
+
+	ln, err := server.ListenTCP(&net.TCPAddr{Port: 18000})
+	if err != nil {
+		log.Fatalf("Listen error : %v", err)
+	}
+	go func() {
+		conn, err := ln.AcceptTCP()
+		if err != nil {
+			log.Fatalf("Accept error : %v", err)
+		}
+		defer conn.Close()
+
+		buf := make([]byte, 1500)
+		n, err := conn.Read(buf)
+		if err != nil {
+			log.Fatalf("Read error : %v", err)
+		}
+		fmt.Printf("server recv : %s\n", buf[:n])
+		conn.SetDeathFlagPolicy(rfc9401.DeathFlagRule{When: rfc9401.DeathFlagAlways})
+		conn.Write(rfc9401.CreateHttpResp("もう何も怖くない\n"))
+	}()
+
+	conn, err := client.DialTCP(nil, &net.TCPAddr{IP: serverAddr.AsSlice(), Port: 18000})
+	if err != nil {
+		log.Fatalf("Dial error : %v", err)
+	}
+	go func() {
+		for ev := range conn.DeathFlagEvents() {
+			fmt.Printf("death flag : seq %d, len %d, preceded fin %v\n", ev.Seq, ev.Length, ev.PrecededFin)
+		}
+	}()
+	if _, err = conn.Write(rfc9401.CreateHttpGet(serverAddr.String(), 18000)); err != nil {
+		log.Fatalf("Write error : %v", err)
+	}
+	resp, err := io.ReadAll(conn)
+	if err != nil {
+		log.Fatalf("Read error : %v", err)
+	}
+	fmt.Println(string(resp))
+	conn.Close()
+}
@@ -0,0 +1,47 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/netip"
+	"rfc9401"
+)
+
+// TUNデバイスを作って10.9.0.2:18000でHTTPを受ける。カーネルのTCPからは別のホストに見える
+// sudo go run example/tun.go したあと curl http://10.9.0.2:18000/ で確認できる
+func main() {
+	tun, err := rfc9401.OpenTUN(rfc9401.TUNConfig{
+		HostPrefix: netip.MustParsePrefix("10.9.0.1/24"),
+		LocalAddr:  netip.MustParseAddr("10.9.0.2"),
+	})
+	if err != nil {
+		log.Fatalf("OpenTUN error : %v", err)
+	}
+	// 読み込みを始める前に設定しておく
+	stack := rfc9401.NewStackWithConfig(rfc9401.StackConfig{ResetClosedPorts: true}, tun)
+	defer stack.Close()
+
+	ln, err := stack.ListenTCP(&net.TCPAddr{Port: 18000})
+	if err != nil {
+		log.Fatalf("Listen error : %v", err)
+	}
+	for {
+		conn, err := ln.AcceptTCP()
+		if err != nil {
+			log.Fatalf("Accept error : %v", err)
+		}
+		go func() {
+			defer conn.Close()
+			buf := make([]byte, 1500)
+			n, err := conn.Read(buf)
+			if err != nil {
+				return
+			}
+			fmt.Printf("server recv : %s\n", buf[:n])
+			conn.Write(rfc9401.CreateHttpResp("もう何も怖くない\n"))
+		}()
+	}
+}
@@ -1,7 +1,9 @@
 package rfc9401
 
 import (
+	"bytes"
 	"fmt"
+	"io"
 	"strconv"
 	"strings"
 )
@@ -84,13 +86,14 @@ func HttpGet(client, server string, port int) (string, error) {
 	if err != nil {
 		return "", err
 	}
+	defer conn.Close()
 
-	conn, data, err := conn.Write(CreateHttpGet(server, port), true)
-	if err != nil {
+	conn.SetDeathFlagPolicy(DeathFlagRule{When: DeathFlagAlways})
+	if _, err = conn.Write(CreateHttpGet(server, port)); err != nil {
 		return "", err
 	}
-	defer conn.Close()
 
+	data, err := readHttpMessage(conn)
 	return string(data), err
 }
 
@@ -100,27 +103,104 @@ func HttpPost(client, server string, port int, postdata string) (string, error)
 	if err != nil {
 		return "", err
 	}
+	defer conn.Close()
 
-	conn, data, err := conn.Write(CreateHttpPost(server, port, postdata), true)
-	if err != nil {
+	conn.SetDeathFlagPolicy(DeathFlagRule{When: DeathFlagAlways})
+	if _, err = conn.Write(CreateHttpPost(server, port, postdata)); err != nil {
 		return "", err
 	}
-	defer conn.Close()
 
+	data, err := readHttpMessage(conn)
 	return string(data), err
 }
 
 func ListenAndServeHTTP(listenAddr string, port int) error {
-	chHeader := make(chan TcpState)
-	go func() {
-		Listen(listenAddr, port, chHeader)
-	}()
+	ln, err := Listen(listenAddr, port)
+	if err != nil {
+		return err
+	}
+	defer ln.Close()
+
 	for {
-		result := <-chHeader
-		if result.err != nil {
-			return result.err
+		conn, err := ln.AcceptTCP()
+		if err != nil {
+			return err
 		}
-		fmt.Printf("ListenAndServeHTTP result header is %+v\n", result.tcpHeader)
+		go serveHTTP(conn)
 	}
+}
+
+func serveHTTP(conn *Conn) {
+	defer conn.Close()
+
+	req, err := readHttpMessage(conn)
+	if err != nil {
+		fmt.Printf("read request err : %v\n", err)
+		return
+	}
+	fmt.Printf("ListenAndServeHTTP request is %s\n", req)
 
+	// サーバならHTTPレスポンスを返す
+	fmt.Println("Send PSHACK Packet From server")
+	conn.SetDeathFlagPolicy(DeathFlagRule{When: DeathFlagAlways})
+	if _, err = conn.Write(CreateHttpResp("もう何も怖くない\n")); err != nil {
+		fmt.Printf("write response err : %v\n", err)
+	}
+}
+
+// readHttpMessage はHTTPメッセージを1つ読み出す。
+// ヘッダの終わりまで読んでから、Content-Lengthがあればその長さのボディを読む。
+// Content-Lengthのないレスポンスは相手が閉じるまで読み、リクエストはボディなしとする
+func readHttpMessage(conn *Conn) ([]byte, error) {
+	var msg []byte
+	buf := make([]byte, 4096)
+	headerLen, bodyLen := -1, -1
+	for {
+		if headerLen < 0 {
+			headerLen, bodyLen = parseHttpLength(msg)
+		}
+		if headerLen >= 0 && bodyLen >= 0 && len(msg) >= headerLen+bodyLen {
+			return msg[:headerLen+bodyLen], nil
+		}
+		n, err := conn.Read(buf)
+		msg = append(msg, buf[:n]...)
+		if err == io.EOF && headerLen >= 0 && bodyLen < 0 {
+			return msg, nil
+		}
+		if err == io.EOF {
+			return nil, io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// parseHttpLength はmsgのヘッダの長さとContent-Lengthを返す。
+// ヘッダが終わっていなければ-1を返し、ボディの長さが分からなければbodyLenを-1にする
+func parseHttpLength(msg []byte) (headerLen int, bodyLen int) {
+	// このパッケージのリクエストは改行がLFだけなのでどちらも受け付ける
+	end, sep := bytes.Index(msg, []byte("\r\n\r\n")), 4
+	if lf := bytes.Index(msg, []byte("\n\n")); lf >= 0 && (end < 0 || lf < end) {
+		end, sep = lf, 2
+	}
+	if end < 0 {
+		return -1, -1
+	}
+	header := string(msg[:end])
+	for _, line := range strings.Split(header, "\n") {
+		key, value, ok := strings.Cut(strings.TrimSuffix(line, "\r"), ":")
+		if !ok || !strings.EqualFold(strings.TrimSpace(key), "Content-Length") {
+			continue
+		}
+		length, err := strconv.Atoi(strings.TrimSpace(value))
+		if err != nil || length < 0 {
+			continue
+		}
+		return end + sep, length
+	}
+	if strings.HasPrefix(header, "HTTP/") {
+		return end + sep, -1
+	}
+	return end + sep, 0
 }
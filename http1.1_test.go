@@ -0,0 +1,43 @@
+package rfc9401
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadHttpMessage(t *testing.T) {
+	body := strings.Repeat("もう何も怖くない\n", 1000)
+	for _, tc := range []struct {
+		name   string
+		chunks []string
+		close  bool
+		want   string
+	}{
+		{"request without body", []string{string(CreateHttpGet("192.0.2.2", 80))}, false, string(CreateHttpGet("192.0.2.2", 80))},
+		{"request split in header", []string{"POST / HTTP/1.1\nContent-Le", "ngth: 5\n\nhel", "lo"}, false, "POST / HTTP/1.1\nContent-Length: 5\n\nhello"},
+		{"response over several segments", []string{string(CreateHttpResp(body))[:100], string(CreateHttpResp(body))[100:]}, false, string(CreateHttpResp(body))},
+		{"response until close", []string{"HTTP/1.1 200 OK\r\n\r\n", body}, true, "HTTP/1.1 200 OK\r\n\r\n" + body},
+	} {
+		c, s := pipeStacks(t)
+		conn, srv := dialPipe(t, c, s)
+		go func(chunks []string, close bool) {
+			for _, chunk := range chunks {
+				srv.Write([]byte(chunk))
+				time.Sleep(20 * time.Millisecond)
+			}
+			if close {
+				srv.Close()
+			}
+		}(tc.chunks, tc.close)
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		got, err := readHttpMessage(conn)
+		if err != nil {
+			t.Fatalf("%s : %v", tc.name, err)
+		}
+		if !bytes.Equal(got, []byte(tc.want)) {
+			t.Fatalf("%s : read %d bytes, want %d", tc.name, len(got), len(tc.want))
+		}
+	}
+}
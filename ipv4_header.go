@@ -0,0 +1,179 @@
+package rfc9401
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"rfc9401/checksum"
+	"sync/atomic"
+)
+
+/*
+ 0                   1                   2                   3
+ 0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1
++-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+|Version|  IHL  |   DSCP    |ECN|          Total Length         |
++-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+|         Identification        |Flags|      Fragment Offset    |
++-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+|  Time to Live |    Protocol   |         Header Checksum       |
++-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+|                       Source Address                          |
++-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+|                    Destination Address                        |
++-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+|                    Options                    |    Padding    |
++-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+*/
+
+const (
+	IPProtocolTCP = 0x06
+	// IPv4ヘッダの固定部分の長さ
+	ipv4HeaderLength = 20
+	// 送るパケットのTTLのデフォルト
+	defaultTTL = 64
+)
+
+var ErrInvalidIPv4Header = errors.New("invalid ipv4 header")
+
+// IPv4Header はIPv4ヘッダ (RFC791)
+type IPv4Header struct {
+	// IHL はオプションを含めたヘッダ長をbyteで表したもの
+	IHL  int
+	DSCP uint8
+	ECN  uint8
+	// TotalLength はヘッダとペイロードを合わせた長さ
+	TotalLength    int
+	Identification uint16
+	DontFragment   bool
+	MoreFragments  bool
+	// FragmentOffset は8byte単位
+	FragmentOffset uint16
+	TTL            uint8
+	Protocol       uint8
+	Checksum       uint16
+	Src            netip.Addr
+	Dst            netip.Addr
+	Options        []byte
+}
+
+// ParseIPv4Header はパケットの先頭のIPv4ヘッダを読み、チェックサムと長さを確かめる。
+// フラグメントは組み立てないのでエラーにする
+func ParseIPv4Header(packet []byte) (IPv4Header, error) {
+	var h IPv4Header
+	if len(packet) < ipv4HeaderLength {
+		return h, fmt.Errorf("%w : too short %d bytes", ErrInvalidIPv4Header, len(packet))
+	}
+	if version := packet[0] >> 4; version != 4 {
+		return h, fmt.Errorf("%w : version %d", ErrInvalidIPv4Header, version)
+	}
+	h.IHL = int(packet[0]&0x0f) * 4
+	h.DSCP = packet[1] >> 2
+	h.ECN = packet[1] & 0x03
+	h.TotalLength = int(byteToUint16(packet[2:4]))
+	h.Identification = byteToUint16(packet[4:6])
+	h.DontFragment = packet[6]&0x40 != 0
+	h.MoreFragments = packet[6]&0x20 != 0
+	h.FragmentOffset = byteToUint16(packet[6:8]) & 0x1fff
+	h.TTL = packet[8]
+	h.Protocol = packet[9]
+	h.Checksum = byteToUint16(packet[10:12])
+	h.Src, _ = netip.AddrFromSlice(packet[12:16])
+	h.Dst, _ = netip.AddrFromSlice(packet[16:20])
+
+	if h.IHL < ipv4HeaderLength || h.IHL > len(packet) {
+		return h, fmt.Errorf("%w : header length %d", ErrInvalidIPv4Header, h.IHL)
+	}
+	if h.TotalLength < h.IHL || h.TotalLength > len(packet) {
+		return h, fmt.Errorf("%w : total length %d", ErrInvalidIPv4Header, h.TotalLength)
+	}
+	// チェックサムを含めて足すと0になる
+	if sum := calcChecksum(packet[:h.IHL]); sum[0] != 0 || sum[1] != 0 {
+		return h, fmt.Errorf("%w : bad checksum %#04x", ErrInvalidIPv4Header, h.Checksum)
+	}
+	if h.MoreFragments || h.FragmentOffset != 0 {
+		return h, fmt.Errorf("%w : fragments are not supported", ErrInvalidIPv4Header)
+	}
+	if h.Src.IsMulticast() || h.Src == netip.IPv4Unspecified() || h.Dst == netip.IPv4Unspecified() {
+		return h, fmt.Errorf("%w : address %s -> %s", ErrInvalidIPv4Header, h.Src, h.Dst)
+	}
+	if h.IHL > ipv4HeaderLength {
+		h.Options = packet[ipv4HeaderLength:h.IHL]
+	}
+
+	return h, nil
+}
+
+// NewIPv4Header はpayloadLength byteのTCPセグメントを送るためのヘッダを作る
+func NewIPv4Header(src, dst netip.Addr, payloadLength int, id uint16) IPv4Header {
+	return IPv4Header{
+		IHL:            ipv4HeaderLength,
+		TotalLength:    ipv4HeaderLength + payloadLength,
+		Identification: id,
+		DontFragment:   true,
+		TTL:            defaultTTL,
+		Protocol:       IPProtocolTCP,
+		Src:            src,
+		Dst:            dst,
+	}
+}
+
+// Marshal はヘッダをbyteにしてチェックサムをセットする。オプションは4byte境界まで0で埋める
+func (h *IPv4Header) Marshal() ([]byte, error) {
+	if !h.Src.Is4() || !h.Dst.Is4() {
+		return nil, fmt.Errorf("%w : address %s -> %s", ErrInvalidIPv4Header, h.Src, h.Dst)
+	}
+	optLen := (len(h.Options) + 3) &^ 3
+	h.IHL = ipv4HeaderLength + optLen
+	if h.IHL > 60 {
+		return nil, fmt.Errorf("%w : options too long %d bytes", ErrInvalidIPv4Header, len(h.Options))
+	}
+	if h.TotalLength < h.IHL || h.TotalLength > 0xffff {
+		return nil, fmt.Errorf("%w : total length %d", ErrInvalidIPv4Header, h.TotalLength)
+	}
+
+	b := make([]byte, h.IHL)
+	b[0] = 4<<4 | uint8(h.IHL/4)
+	b[1] = h.DSCP<<2 | h.ECN&0x03
+	copy(b[2:4], uint16ToByte(uint16(h.TotalLength)))
+	copy(b[4:6], uint16ToByte(h.Identification))
+	frag := h.FragmentOffset & 0x1fff
+	if h.DontFragment {
+		frag |= 0x4000
+	}
+	if h.MoreFragments {
+		frag |= 0x2000
+	}
+	copy(b[6:8], uint16ToByte(frag))
+	b[8] = h.TTL
+	b[9] = h.Protocol
+	src, dst := h.Src.As4(), h.Dst.As4()
+	copy(b[12:16], src[:])
+	copy(b[16:20], dst[:])
+	copy(b[ipv4HeaderLength:], h.Options)
+	checksum := calcChecksum(b)
+	copy(b[10:12], checksum)
+	h.Checksum = byteToUint16(checksum)
+
+	return b, nil
+}
+
+// Payload はpacketからこのヘッダの後ろのペイロードを取り出す
+func (h *IPv4Header) Payload(packet []byte) []byte {
+	return packet[h.IHL:h.TotalLength]
+}
+
+// PseudoHeader はlength byteのTCPセグメントの疑似ヘッダの和を返す。
+// checksum.Checksumの初期値に渡すとペイロードのTCPチェックサムを計算できる
+func (h *IPv4Header) PseudoHeader(length int) uint64 {
+	return checksum.PseudoHeader(h.Src, h.Dst, IPProtocolTCP, length)
+}
+
+// ipv4IDCounter はIPv4ヘッダのIdentificationを送るたびに1つずつ進める
+type ipv4IDCounter struct {
+	n atomic.Uint32
+}
+
+func (c *ipv4IDCounter) next() uint16 {
+	return uint16(c.n.Add(1))
+}
@@ -0,0 +1,102 @@
+package rfc9401
+
+import (
+	"bytes"
+	"errors"
+	"net/netip"
+	"rfc9401/checksum"
+	"testing"
+)
+
+func TestIPv4Header(t *testing.T) {
+	src := netip.MustParseAddr("192.0.2.1")
+	dst := netip.MustParseAddr("192.0.2.2")
+	payload := []byte("payload")
+
+	// marshal はヘッダを組み立てて後ろにペイロードを付ける
+	marshal := func(h *IPv4Header) []byte {
+		b, err := h.Marshal()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return append(b, payload...)
+	}
+	h := NewIPv4Header(src, dst, len(payload), 0x1234)
+	h.DSCP = 46
+	h.ECN = 2
+	h.Options = []byte{0x94, 0x04, 0x00} // Router Alertを3byteにして詰め物をさせる
+	h.TotalLength += 4
+	packet := marshal(&h)
+
+	got, err := ParseIPv4Header(packet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.IHL != 24 || got.DSCP != 46 || got.ECN != 2 || !got.DontFragment || got.Identification != 0x1234 ||
+		got.TTL != defaultTTL || got.Protocol != IPProtocolTCP || got.Src != src || got.Dst != dst || got.Checksum != h.Checksum {
+		t.Fatalf("got %+v, want %+v", got, h)
+	}
+	// オプションは4byte境界まで0で埋める
+	if !bytes.Equal(got.Options, []byte{0x94, 0x04, 0x00, 0x00}) {
+		t.Fatalf("got options %x", got.Options)
+	}
+	if !bytes.Equal(got.Payload(packet), payload) {
+		t.Fatalf("got payload %q", got.Payload(packet))
+	}
+	if sum := got.PseudoHeader(len(payload)); sum != checksum.PseudoHeader(src, dst, IPProtocolTCP, len(payload)) {
+		t.Fatalf("got pseudo header sum %#x", sum)
+	}
+
+	corrupt := func(f func(b []byte)) []byte {
+		b := append([]byte(nil), packet...)
+		f(b)
+		return b
+	}
+	fragment := h
+	fragment.MoreFragments = true
+	offset := h
+	offset.FragmentOffset = 1
+	multicast := h
+	multicast.Src = netip.MustParseAddr("224.0.0.1")
+	for _, tc := range []struct {
+		name   string
+		packet []byte
+	}{
+		{"short", packet[:19]},
+		{"version 6", corrupt(func(b []byte) { b[0] = 6<<4 | 6 })},
+		{"header length below 20", corrupt(func(b []byte) { b[0] = 4<<4 | 4 })},
+		{"header length beyond packet", corrupt(func(b []byte) { b[0] = 4<<4 | 15 })},
+		{"total length below header", corrupt(func(b []byte) { b[2], b[3] = 0, 20 })},
+		{"total length beyond packet", corrupt(func(b []byte) { b[2], b[3] = 0, 200 })},
+		{"bad checksum", corrupt(func(b []byte) { b[8]-- })},
+		{"more fragments", marshal(&fragment)},
+		{"fragment offset", marshal(&offset)},
+		{"multicast source", marshal(&multicast)},
+	} {
+		if _, err := ParseIPv4Header(tc.packet); !errors.Is(err, ErrInvalidIPv4Header) {
+			t.Errorf("%s : got %v, want %v", tc.name, err, ErrInvalidIPv4Header)
+		}
+	}
+
+	for _, tc := range []struct {
+		name string
+		h    IPv4Header
+	}{
+		{"ipv6 address", NewIPv4Header(netip.MustParseAddr("2001:db8::1"), dst, 0, 0)},
+		{"options too long", IPv4Header{Src: src, Dst: dst, TotalLength: 100, Options: make([]byte, 41)}},
+		{"total length too large", NewIPv4Header(src, dst, 0xffff, 0)},
+	} {
+		if _, err := tc.h.Marshal(); !errors.Is(err, ErrInvalidIPv4Header) {
+			t.Errorf("%s : got %v, want %v", tc.name, err, ErrInvalidIPv4Header)
+		}
+	}
+}
+
+func TestIPv4IDCounter(t *testing.T) {
+	var c ipv4IDCounter
+	c.n.Store(0xffff)
+	// 16bitを超えたら0に戻る
+	if a, b := c.next(), c.next(); a != 0 || b != 1 {
+		t.Fatalf("got %d, %d, want 0, 1", a, b)
+	}
+}
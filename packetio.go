@@ -0,0 +1,80 @@
+package rfc9401
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+)
+
+// PacketIO はStackがTCPセグメントを送受信するための下位層
+type PacketIO interface {
+	// ReadPacket はTCPセグメントを1つbに読み込み、送信元と宛先のIPアドレスを返す
+	ReadPacket(b []byte) (n int, src netip.Addr, dst netip.Addr, err error)
+	// WritePacket はTCPセグメントbをsrcからdstへ送る。bは呼び出し側が使い回すので、戻ったあとに参照しないこと
+	WritePacket(b []byte, src netip.Addr, dst netip.Addr) error
+	// LocalAddr は自分のIPアドレスを返す
+	LocalAddr() netip.Addr
+	Close() error
+}
+
+// mtuPacketIO はリンクのMTUが分かるPacketIO。
+// PacketIOがMTU() intを持っていれば、StackはMTUからIPとTCPのヘッダを引いたMSSを広告する
+type mtuPacketIO interface {
+	MTU() int
+}
+
+// RawSocketMark はRawSocketが送るパケットに付けるマーク(SO_MARK)。
+// RSTSuppressorのルールはこのマークの付いたRSTを捨てないので、Stackが自分で送るRSTは相手に届く
+const RawSocketMark = 0x9401
+
+// RawSocket はip:tcpかip6:tcpのraw socketを使うPacketIO。IPヘッダはカーネルが付ける
+type RawSocket struct {
+	pconn net.PacketConn
+	addr  netip.Addr
+}
+
+// ListenRaw はlocalAddrにraw socketを開く。IPv6のアドレスならip6:tcpで開く。root権限が必要
+func ListenRaw(localAddr string) (*RawSocket, error) {
+	addr, err := netip.ParseAddr(localAddr)
+	if err != nil || addr.IsUnspecified() {
+		return nil, fmt.Errorf("invalid local address : %s", localAddr)
+	}
+	addr = addr.Unmap()
+	network := NETWORK_STR
+	if addr.Is6() {
+		network = NETWORK6_STR
+	}
+	pconn, err := net.ListenPacket(network, addr.String())
+	if err != nil {
+		return nil, fmt.Errorf("Listen is err : %v", err)
+	}
+	if err := setMark(pconn); err != nil {
+		// マークがなくても送受信はできるが、RSTを捨てるルールがあるとStackの送るRSTも捨てられる
+		fmt.Printf("set socket mark err : %v\n", err)
+	}
+	return &RawSocket{pconn: pconn, addr: addr}, nil
+}
+
+func (raw *RawSocket) ReadPacket(b []byte) (int, netip.Addr, netip.Addr, error) {
+	n, clientAddr, err := raw.pconn.ReadFrom(b)
+	if err != nil {
+		return 0, netip.Addr{}, netip.Addr{}, err
+	}
+	// IPv4のアドレスは16byteで返ってくることがあるのでIPv4に戻す
+	ipAddr := clientAddr.(*net.IPAddr)
+	src, _ := netip.AddrFromSlice(ipAddr.IP)
+	return n, src.Unmap().WithZone(ipAddr.Zone), raw.addr, nil
+}
+
+func (raw *RawSocket) WritePacket(b []byte, src netip.Addr, dst netip.Addr) error {
+	_, err := raw.pconn.WriteTo(b, &net.IPAddr{IP: dst.AsSlice(), Zone: dst.Zone()})
+	return err
+}
+
+func (raw *RawSocket) LocalAddr() netip.Addr {
+	return raw.addr
+}
+
+func (raw *RawSocket) Close() error {
+	return raw.pconn.Close()
+}
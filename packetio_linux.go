@@ -0,0 +1,26 @@
+package rfc9401
+
+import (
+	"net"
+	"syscall"
+)
+
+// setMark はraw socketから送るパケットにRawSocketMarkを付ける。CAP_NET_ADMINが必要
+func setMark(pconn net.PacketConn) error {
+	sc, ok := pconn.(syscall.Conn)
+	if !ok {
+		return nil
+	}
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var serr error
+	err = rc.Control(func(fd uintptr) {
+		serr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_MARK, RawSocketMark)
+	})
+	if err != nil {
+		return err
+	}
+	return serr
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package rfc9401
+
+import "net"
+
+// setMark はLinux以外ではパケットにマークを付けられないので何もしない
+func setMark(pconn net.PacketConn) error {
+	return nil
+}
@@ -0,0 +1,76 @@
+package rfc9401
+
+import (
+	"net"
+	"net/netip"
+	"sync"
+)
+
+// 相手が読み出していないパケットをためておける数
+const pipeQueueSize = 1024
+
+type pipePacket struct {
+	data *[]byte
+	src  netip.Addr
+	dst  netip.Addr
+}
+
+// PipeIO はプロセス内で2つのStackをつなぐPacketIO。root権限なしで動かせる
+type PipeIO struct {
+	addr netip.Addr
+	recv chan pipePacket
+	peer *PipeIO
+
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+// Pipe はaddrAとaddrBをつなぐPacketIOのペアを返す
+func Pipe(addrA, addrB netip.Addr) (*PipeIO, *PipeIO) {
+	a := &PipeIO{addr: addrA, recv: make(chan pipePacket, pipeQueueSize), done: make(chan struct{})}
+	b := &PipeIO{addr: addrB, recv: make(chan pipePacket, pipeQueueSize), done: make(chan struct{})}
+	a.peer = b
+	b.peer = a
+	return a, b
+}
+
+func (p *PipeIO) ReadPacket(b []byte) (int, netip.Addr, netip.Addr, error) {
+	select {
+	case pkt := <-p.recv:
+		n := copy(b, *pkt.data)
+		putPacketBuffer(pkt.data)
+		return n, pkt.src, pkt.dst, nil
+	case <-p.done:
+		return 0, netip.Addr{}, netip.Addr{}, net.ErrClosed
+	}
+}
+
+// WritePacket はbをコピーして相手に渡す。相手の受信キューがいっぱいであれば捨てる
+func (p *PipeIO) WritePacket(b []byte, src netip.Addr, dst netip.Addr) error {
+	select {
+	case <-p.done:
+		return net.ErrClosed
+	default:
+	}
+	// コピーするバッファは相手がReadPacketで読んだらプールに返す
+	buf := getPacketBuffer()
+	*buf = append(*buf, b...)
+	pkt := pipePacket{data: buf, src: src, dst: dst}
+	select {
+	case p.peer.recv <- pkt:
+	case <-p.peer.done:
+		putPacketBuffer(buf)
+	default:
+		putPacketBuffer(buf)
+	}
+	return nil
+}
+
+func (p *PipeIO) LocalAddr() netip.Addr {
+	return p.addr
+}
+
+func (p *PipeIO) Close() error {
+	p.closeOnce.Do(func() { close(p.done) })
+	return nil
+}
@@ -0,0 +1,215 @@
+package rfc9401
+
+import (
+	"fmt"
+	"net/netip"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// RSTSuppressor はRawSocketで通信するポートについて、カーネルが送るRSTを捨てるルールを入れたり消したりする。
+// カーネルは自分の知らないコネクションのセグメントにRSTを返すので、これがないとハンドシェイクが切られてしまう
+type RSTSuppressor interface {
+	// Suppress はlocalから出ていくRSTを捨てるルールを入れる。
+	// RawSocketMarkの付いたパケットはStackが送ったものなので捨てないこと
+	Suppress(local netip.AddrPort) error
+	// Release はSuppressで入れたルールを消す
+	Release(local netip.AddrPort) error
+}
+
+// DefaultRSTSuppressor はDial, Listenなどで作られるRawSocketのStackに使われる。nilならルールを入れない
+var DefaultRSTSuppressor RSTSuppressor
+
+// nftablesで使うテーブルの名前
+const nftTable = "rfc9401"
+
+// IPTablesSuppressor はiptablesでポートごとにRSTをDROPするルールを入れる
+type IPTablesSuppressor struct {
+	// DryRun がtrueならコマンドを実行せずに表示だけする
+	DryRun bool
+}
+
+func (s *IPTablesSuppressor) Suppress(local netip.AddrPort) error {
+	return runCommand(s.DryRun, "", iptablesCommand(local), iptablesRule("-A", local)...)
+}
+
+func (s *IPTablesSuppressor) Release(local netip.AddrPort) error {
+	return runCommand(s.DryRun, "", iptablesCommand(local), iptablesRule("-D", local)...)
+}
+
+func iptablesCommand(local netip.AddrPort) string {
+	if local.Addr().Is6() {
+		return "ip6tables"
+	}
+	return "iptables"
+}
+
+func iptablesRule(op string, local netip.AddrPort) []string {
+	return []string{
+		op, "OUTPUT",
+		"-p", "tcp",
+		"-s", local.Addr().String(),
+		"--sport", strconv.Itoa(int(local.Port())),
+		"--tcp-flags", "RST", "RST",
+		"-m", "mark", "!", "--mark", markString(),
+		"-m", "comment", "--comment", nftTable,
+		"-j", "DROP",
+	}
+}
+
+// NFTablesSuppressor はnftablesのテーブルを1つ作り、そのセットにアドレスとポートを出し入れする
+type NFTablesSuppressor struct {
+	// DryRun がtrueならコマンドを実行せずに表示だけする
+	DryRun bool
+
+	mu    sync.Mutex
+	ready bool
+}
+
+// nftables のテーブル。セットに入っているアドレスとポートから出ていくRSTのうち、カーネルが送ったものを捨てる
+var nftRuleset = `add table inet ` + nftTable + `
+delete table inet ` + nftTable + `
+table inet ` + nftTable + ` {
+	set ports4 {
+		type ipv4_addr . inet_service
+	}
+	set ports6 {
+		type ipv6_addr . inet_service
+	}
+	chain output {
+		type filter hook output priority 0; policy accept;
+		ip saddr . tcp sport @ports4 tcp flags & rst == rst meta mark != ` + markString() + ` drop
+		ip6 saddr . tcp sport @ports6 tcp flags & rst == rst meta mark != ` + markString() + ` drop
+	}
+}
+`
+
+func (s *NFTablesSuppressor) Suppress(local netip.AddrPort) error {
+	if err := s.setup(); err != nil {
+		return err
+	}
+	return runCommand(s.DryRun, "", "nft", "add", "element", "inet", nftTable, nftSet(local), nftElement(local))
+}
+
+func (s *NFTablesSuppressor) Release(local netip.AddrPort) error {
+	return runCommand(s.DryRun, "", "nft", "delete", "element", "inet", nftTable, nftSet(local), nftElement(local))
+}
+
+// Close はテーブルごとルールを消す
+func (s *NFTablesSuppressor) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.ready {
+		return nil
+	}
+	s.ready = false
+	return runCommand(s.DryRun, "", "nft", "delete", "table", "inet", nftTable)
+}
+
+// setup は最初に使うときに前のテーブルが残っていれば消して作り直す
+func (s *NFTablesSuppressor) setup() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.ready {
+		return nil
+	}
+	if err := runCommand(s.DryRun, nftRuleset, "nft", "-f", "-"); err != nil {
+		return err
+	}
+	s.ready = true
+	return nil
+}
+
+// markString はルールに書くRawSocketMarkを返す
+func markString() string {
+	return fmt.Sprintf("%#x", RawSocketMark)
+}
+
+func nftSet(local netip.AddrPort) string {
+	if local.Addr().Is6() {
+		return "ports6"
+	}
+	return "ports4"
+}
+
+func nftElement(local netip.AddrPort) string {
+	return fmt.Sprintf("{ %s . %d }", local.Addr(), local.Port())
+}
+
+// runCommand はコマンドを実行する。dryRunなら実行するコマンドを表示するだけにする
+func runCommand(dryRun bool, stdin string, name string, args ...string) error {
+	if dryRun {
+		fmt.Println(name + " " + strings.Join(args, " "))
+		if stdin != "" {
+			fmt.Print(stdin)
+		}
+		return nil
+	}
+	cmd := exec.Command(name, args...)
+	if stdin != "" {
+		cmd.Stdin = strings.NewReader(stdin)
+	}
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%s %s : %v : %s", name, strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// suppressRST はアドレスとポートを使い始めるときにRSTを捨てるルールを入れる。
+// リスナーと受け入れたコネクションは同じポートを使うので数を数え、最初の1つのときだけ入れる。
+// コマンドを実行するので、Stackやコネクションのロックを取っていないところから呼ぶこと
+func (s *Stack) suppressRST(local netip.AddrPort) error {
+	if s.RSTSuppressor == nil {
+		return nil
+	}
+	s.rstMu.Lock()
+	defer s.rstMu.Unlock()
+
+	if s.suppressed[local] == 0 {
+		if err := s.RSTSuppressor.Suppress(local); err != nil {
+			return err
+		}
+	}
+	s.suppressed[local]++
+	return nil
+}
+
+// releaseRST はアドレスとポートを使うものがなくなったらルールを消す。
+// suppressRSTと同じくロックを取っていないところから呼ぶこと
+func (s *Stack) releaseRST(local netip.AddrPort) {
+	if s.RSTSuppressor == nil {
+		return
+	}
+	s.rstMu.Lock()
+	defer s.rstMu.Unlock()
+
+	if s.suppressed[local] == 0 {
+		return
+	}
+	s.suppressed[local]--
+	if s.suppressed[local] > 0 {
+		return
+	}
+	delete(s.suppressed, local)
+	if err := s.RSTSuppressor.Release(local); err != nil {
+		fmt.Printf("release rst rule err : %v\n", err)
+	}
+}
+
+// releaseRSTLater はロックを取っているところから別のgoroutineでreleaseRSTを呼ぶ。
+// 数はrstMuの中で数えるので、後から入れたルールと順番が入れ替わっても残るルールは変わらない。
+// Stack.Closeは呼び出したものが終わるのを待つ
+func (s *Stack) releaseRSTLater(local netip.AddrPort) {
+	if s.RSTSuppressor == nil {
+		return
+	}
+	s.rstReleases.Add(1)
+	go func() {
+		defer s.rstReleases.Done()
+		s.releaseRST(local)
+	}()
+}
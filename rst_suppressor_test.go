@@ -0,0 +1,95 @@
+package rfc9401
+
+import (
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// lockCheckSuppressor はルールを数え、Stackのロックを取ったまま呼ばれていないかを確かめる
+type lockCheckSuppressor struct {
+	t     *testing.T
+	stack *Stack
+
+	mu    sync.Mutex
+	rules map[netip.AddrPort]int
+}
+
+func (s *lockCheckSuppressor) check(op string, local netip.AddrPort) {
+	// 呼び出し元がロックを取っていれば、戻るまで別のgoroutineからは取れない
+	locked := make(chan struct{})
+	go func() {
+		s.stack.mu.Lock()
+		s.stack.mu.Unlock()
+		close(locked)
+	}()
+	select {
+	case <-locked:
+	case <-time.After(time.Second):
+		s.t.Errorf("%s %v is called with the stack lock held", op, local)
+	}
+}
+
+func (s *lockCheckSuppressor) Suppress(local netip.AddrPort) error {
+	s.check("Suppress", local)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rules[local]++
+	return nil
+}
+
+func (s *lockCheckSuppressor) Release(local netip.AddrPort) error {
+	s.check("Release", local)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rules[local]--
+	if s.rules[local] == 0 {
+		delete(s.rules, local)
+	}
+	return nil
+}
+
+func TestRSTSuppressorOutsideLocks(t *testing.T) {
+	c, s := pipeStacks(t)
+	cs := &lockCheckSuppressor{t: t, stack: c, rules: make(map[netip.AddrPort]int)}
+	ss := &lockCheckSuppressor{t: t, stack: s, rules: make(map[netip.AddrPort]int)}
+	c.RSTSuppressor, s.RSTSuppressor = cs, ss
+
+	ln, err := s.ListenTCP(&net.TCPAddr{Port: 80})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go echoServer(ln)
+	for i := 0; i < 3; i++ {
+		conn, err := c.DialTCP(nil, &net.TCPAddr{IP: net.IP{192, 0, 2, 2}, Port: 80})
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Write([]byte("ping"))
+		conn.Read(make([]byte, 4))
+		conn.Close()
+	}
+
+	// Closeは消しているルールを待つので、すべて消えている
+	c.Close()
+	s.Close()
+	for _, sup := range []*lockCheckSuppressor{cs, ss} {
+		if len(sup.rules) != 0 {
+			t.Errorf("rules left : %v", sup.rules)
+		}
+	}
+}
+
+func TestRSTSuppressorRulesExemptMark(t *testing.T) {
+	local := netip.MustParseAddrPort("192.0.2.1:80")
+	rule := strings.Join(iptablesRule("-A", local), " ")
+	if !strings.Contains(rule, "-m mark ! --mark 0x9401") {
+		t.Errorf("iptables rule drops RSTs sent by the stack : %s", rule)
+	}
+	if n := strings.Count(nftRuleset, "meta mark != 0x9401 drop"); n != 2 {
+		t.Errorf("nft ruleset exempts the mark in %d rules, want 2 :\n%s", n, nftRuleset)
+	}
+}
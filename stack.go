@@ -0,0 +1,523 @@
+package rfc9401
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+var ErrStackClosed = errors.New("stack closed")
+
+// fourTuple はコネクションを識別する4タプル
+type fourTuple struct {
+	local  netip.AddrPort
+	remote netip.AddrPort
+}
+
+func newFourTuple(localIP netip.Addr, localPort uint16, remoteIP netip.Addr, remotePort uint16) fourTuple {
+	return fourTuple{
+		local:  netip.AddrPortFrom(localIP, localPort),
+		remote: netip.AddrPortFrom(remoteIP, remotePort),
+	}
+}
+
+// tcpAddrPort はnet.TCPAddrをnetip.AddrPortにする。IPv4はIPv4射影アドレスにせずIPv4のまま扱う
+func tcpAddrPort(addr *net.TCPAddr) netip.AddrPort {
+	ip, _ := netip.AddrFromSlice(addr.IP)
+	return netip.AddrPortFrom(ip.Unmap().WithZone(addr.Zone), uint16(addr.Port))
+}
+
+// Stack はPacketIOを持ち、受信したセグメントを4タプルでコネクションに振り分ける。
+// IPv4とIPv6のPacketIOを両方持てば、1つのリスナーで両方のアドレスを待ち受けられる
+type Stack struct {
+	// StackConfig のフィールドは届いたパケットを処理するgoroutineからも読まれる。
+	// NewStackのあとに変えると競合するので、パケットが届く前に決めるときはNewStackWithConfigを使う
+	StackConfig
+
+	mu        sync.Mutex
+	pios      []PacketIO
+	conns     map[fourTuple]*Conn
+	listeners map[uint16]*Listener
+	closed    bool
+
+	// アドレスとポートごとにルールを使っているリスナーとコネクションの数。
+	// ルールのコマンドを実行している間もmuやConnのロックを止めないようにrstMuで守る
+	rstMu      sync.Mutex
+	suppressed map[netip.AddrPort]int
+	// releaseRSTLaterで消しているルールの数
+	rstReleases sync.WaitGroup
+
+	// チェックサムが合わなかったセグメントの数
+	checksums checksumCounters
+
+	// チャレンジACKを送った数と数え始めた時刻
+	challengeAcks    int
+	challengeAckTime time.Time
+}
+
+// StackConfig はStackの設定
+type StackConfig struct {
+	// MaxRetries は再送を諦めてコネクションを破棄するまでの回数。0ならdefaultMaxRetries
+	MaxRetries int
+	// CongestionControl は新しいコネクションで使う輻輳制御アルゴリズムの名前。空ならnewreno。
+	// 登録されていない名前であればDialとListenがエラーを返す
+	CongestionControl string
+	// ISN は初期シーケンス番号を作るジェネレータ。nilならランダムな鍵で作ったものを共有する
+	ISN *ISNGenerator
+	// DeathFlagPolicy は新しいコネクションで使う死亡フラグのポリシー。nilなら死亡フラグを使わない
+	DeathFlagPolicy DeathFlagPolicy
+	// ResetClosedPorts はコネクションもリスナーもないポートに届いたセグメントにRSTを返すか。
+	// RawSocketではカーネルも同じIPアドレスのセグメントを受け取って応答するのでfalseのままにする
+	ResetClosedPorts bool
+	// RSTSuppressor はポートを使っている間カーネルのRSTを捨てるルールを入れる。nilならルールを入れない
+	RSTSuppressor RSTSuppressor
+	// TimeWait はTIME-WAITで待つ時間。0なら2MSL(60秒)
+	TimeWait time.Duration
+	// ChecksumPolicy はチェックサムの計算と確認のしかた。0ならChecksumVerifyLenient
+	ChecksumPolicy ChecksumPolicy
+}
+
+// NewStack はpioを通してセグメントを送受信するStackを作る。
+// 例えばIPv4とIPv6のPacketIOを渡すとデュアルスタックになる
+func NewStack(pio PacketIO, more ...PacketIO) *Stack {
+	return NewStackWithConfig(StackConfig{}, pio, more...)
+}
+
+// NewStackWithConfig はconfigの設定でパケットを読み始めるStackを作る
+func NewStackWithConfig(config StackConfig, pio PacketIO, more ...PacketIO) *Stack {
+	s := &Stack{
+		StackConfig: config,
+		pios:        append([]PacketIO{pio}, more...),
+		conns:       make(map[fourTuple]*Conn),
+		listeners:   make(map[uint16]*Listener),
+		suppressed:  make(map[netip.AddrPort]int),
+	}
+	for _, pio := range s.pios {
+		go s.readLoop(pio)
+	}
+
+	return s
+}
+
+var (
+	defaultStacksMu sync.Mutex
+	defaultStacks   = make(map[netip.Addr]*Stack)
+)
+
+// defaultStack はパッケージ関数のDialやListenで使うIPアドレス毎のStackを返す
+func defaultStack(ip netip.Addr) (*Stack, error) {
+	defaultStacksMu.Lock()
+	defer defaultStacksMu.Unlock()
+
+	if s, ok := defaultStacks[ip]; ok {
+		return s, nil
+	}
+	raw, err := ListenRaw(ip.String())
+	if err != nil {
+		return nil, err
+	}
+	s := NewStackWithConfig(StackConfig{RSTSuppressor: DefaultRSTSuppressor}, raw)
+	defaultStacks[ip] = s
+	return s, nil
+}
+
+// Addrs はStackのIPアドレスをPacketIOの順に返す
+func (s *Stack) Addrs() []netip.Addr {
+	addrs := make([]netip.Addr, 0, len(s.pios))
+	for _, pio := range s.pios {
+		addrs = append(addrs, pio.LocalAddr())
+	}
+	return addrs
+}
+
+func (s *Stack) hasAddr(addr netip.Addr) bool {
+	return s.packetIO(addr) != nil
+}
+
+// packetIO はaddrを自分のアドレスに持つPacketIOを返す。なければnil
+func (s *Stack) packetIO(addr netip.Addr) PacketIO {
+	for _, pio := range s.pios {
+		if pio.LocalAddr() == addr {
+			return pio
+		}
+	}
+	return nil
+}
+
+// localAddrFor はremoteに送るときに使う自分のアドレスを返す。同じアドレスファミリで最初のものを使う
+func (s *Stack) localAddrFor(remote netip.Addr) (netip.Addr, error) {
+	for _, addr := range s.Addrs() {
+		if addr.Is4() == remote.Is4() {
+			return addr, nil
+		}
+	}
+	return netip.Addr{}, fmt.Errorf("no local address to reach %v", remote)
+}
+
+// Close はPacketIOを閉じ、すべてのコネクションとリスナーを終了させる
+func (s *Stack) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return ErrStackClosed
+	}
+	s.closed = true
+	conns := make([]*Conn, 0, len(s.conns))
+	for _, conn := range s.conns {
+		conns = append(conns, conn)
+	}
+	listeners := make([]*Listener, 0, len(s.listeners))
+	for _, ln := range s.listeners {
+		listeners = append(listeners, ln)
+	}
+	s.mu.Unlock()
+
+	for _, ln := range listeners {
+		ln.Close()
+	}
+	for _, conn := range conns {
+		conn.abort(ErrStackClosed)
+	}
+	s.rstReleases.Wait()
+	var err error
+	for _, pio := range s.pios {
+		if e := pio.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// DialTCP はladdrからraddrへコネクションを確立する。
+// laddrのIPはStackのアドレスのどれかである必要があり、Portが0の場合は空いているポートを選ぶ
+func (s *Stack) DialTCP(laddr, raddr *net.TCPAddr) (*Conn, error) {
+	if raddr == nil {
+		return nil, fmt.Errorf("invalid remote address : %v", raddr)
+	}
+	var local netip.AddrPort
+	if laddr != nil {
+		local = tcpAddrPort(laddr)
+	}
+	return s.DialAddrPort(local, tcpAddrPort(raddr))
+}
+
+// DialAddrPort はladdrからraddrへコネクションを確立する。
+// laddrのアドレスが無効か未指定であればraddrと同じアドレスファミリのアドレスを使う
+func (s *Stack) DialAddrPort(laddr, raddr netip.AddrPort) (*Conn, error) {
+	remote := raddr.Addr()
+	if !remote.IsValid() || remote.IsUnspecified() || remote.IsMulticast() {
+		return nil, fmt.Errorf("invalid remote address : %v", raddr)
+	}
+	local := laddr.Addr()
+	if !local.IsValid() || local.IsUnspecified() {
+		var err error
+		if local, err = s.localAddrFor(remote); err != nil {
+			return nil, err
+		}
+	}
+	if !s.hasAddr(local) {
+		return nil, fmt.Errorf("local address %v is not in %v", local, s.Addrs())
+	}
+	if local.Is4() != remote.Is4() {
+		return nil, fmt.Errorf("address family mismatch : %v -> %v", local, remote)
+	}
+	if _, err := newCongestionControl(s.CongestionControl); err != nil {
+		return nil, err
+	}
+
+	conn, err := s.newActiveConn(local, int(laddr.Port()), remote, raddr.Port())
+	if err != nil {
+		return nil, err
+	}
+	if err := conn.connect(); err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
+
+// ListenTCP はladdrのポートでコネクションを待ち受ける。
+// IPがnilか未指定であればStackのすべてのアドレスで待ち受ける
+func (s *Stack) ListenTCP(laddr *net.TCPAddr) (*Listener, error) {
+	if laddr == nil {
+		return nil, fmt.Errorf("invalid listen address : %v", laddr)
+	}
+	return s.ListenAddrPort(tcpAddrPort(laddr))
+}
+
+// ListenAddrPort はladdrのポートでコネクションを待ち受ける。
+// アドレスが無効か未指定(0.0.0.0や::)であれば、IPv4とIPv6を含むStackのすべてのアドレスで待ち受ける
+func (s *Stack) ListenAddrPort(laddr netip.AddrPort) (*Listener, error) {
+	if laddr.Port() == 0 {
+		return nil, fmt.Errorf("invalid listen address : %v", laddr)
+	}
+	addr := laddr.Addr()
+	if addr.IsUnspecified() {
+		addr = netip.Addr{}
+	}
+	if addr.IsValid() && !s.hasAddr(addr) {
+		return nil, fmt.Errorf("local address %v is not in %v", addr, s.Addrs())
+	}
+	if _, err := newCongestionControl(s.CongestionControl); err != nil {
+		return nil, err
+	}
+
+	port := laddr.Port()
+	if err := s.checkListenPort(port); err != nil {
+		return nil, err
+	}
+
+	// コマンドを実行するのでロックを外してからルールを入れる
+	ln := newListener(s, addr, port)
+	locals := ln.localAddrs()
+	release := func(n int) {
+		for _, suppressed := range locals[:n] {
+			s.releaseRST(netip.AddrPortFrom(suppressed, port))
+		}
+	}
+	for i, local := range locals {
+		if err := s.suppressRST(netip.AddrPortFrom(local, port)); err != nil {
+			release(i)
+			return nil, err
+		}
+	}
+
+	s.mu.Lock()
+	err := s.checkListenPortLocked(port)
+	if err == nil {
+		s.listeners[port] = ln
+	}
+	s.mu.Unlock()
+	if err != nil {
+		release(len(locals))
+		return nil, err
+	}
+	return ln, nil
+}
+
+// checkListenPort はportで新しく待ち受けられるかを返す
+func (s *Stack) checkListenPort(port uint16) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.checkListenPortLocked(port)
+}
+
+// checkListenPortLocked はロックを取った状態でportで新しく待ち受けられるかを返す
+func (s *Stack) checkListenPortLocked(port uint16) error {
+	if s.closed {
+		return ErrStackClosed
+	}
+	if _, ok := s.listeners[port]; ok {
+		return fmt.Errorf("port %d is already in use", port)
+	}
+	return nil
+}
+
+// newActiveConn はDialするコネクションを登録する。portが0なら空いているポートを選ぶ
+func (s *Stack) newActiveConn(localIP netip.Addr, port int, remoteIP netip.Addr, remotePort uint16) (*Conn, error) {
+	id, err := s.freeFourTuple(localIP, port, remoteIP, remotePort)
+	if err != nil {
+		return nil, err
+	}
+	// コマンドを実行するのでロックを外してからルールを入れる
+	if err := s.suppressRST(id.local); err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// ルールを入れている間に同じ4タプルが使われたかStackが閉じられた
+	if _, ok := s.conns[id]; ok || s.closed {
+		s.releaseRSTLater(id.local)
+		if s.closed {
+			return nil, ErrStackClosed
+		}
+		return nil, fmt.Errorf("port %d is already in use", id.local.Port())
+	}
+	conn := newConn(s, localIP, id.local.Port())
+	conn.remoteIP = remoteIP
+	conn.remotePort = remotePort
+	s.conns[id] = conn
+
+	return conn, nil
+}
+
+// freeFourTuple はまだ使われていない4タプルを返す。portが0なら空いているポートを選ぶ
+func (s *Stack) freeFourTuple(localIP netip.Addr, port int, remoteIP netip.Addr, remotePort uint16) (fourTuple, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return fourTuple{}, ErrStackClosed
+	}
+	for port == 0 {
+		port = getRandomClientPort()
+		id := newFourTuple(localIP, uint16(port), remoteIP, remotePort)
+		if _, ok := s.conns[id]; ok {
+			port = 0
+		}
+	}
+	id := newFourTuple(localIP, uint16(port), remoteIP, remotePort)
+	if _, ok := s.conns[id]; ok {
+		return fourTuple{}, fmt.Errorf("port %d is already in use", port)
+	}
+	return id, nil
+}
+
+// newPassiveConn はリスナーで受けたSYNに対してLISTEN状態のコネクションを登録する。
+// ロックを取った状態で呼ぶこと。ルールの数はロックを外してから数える
+func (s *Stack) newPassiveConn(ln *Listener, id fourTuple, srcIP netip.Addr, srcPort uint16) *Conn {
+	conn := newConn(s, id.local.Addr(), ln.port)
+	conn.state = StateListen
+	conn.remoteIP = srcIP
+	conn.remotePort = srcPort
+	conn.listener = ln
+	s.conns[id] = conn
+	ln.track(conn)
+	return conn
+}
+
+// mss はlocalから送るときに受け取れるMSSを返す。
+// PacketIOがMTUを知っていればIPとTCPのヘッダを引き、知らなければアドレスファミリのデフォルトにする
+func (s *Stack) mss(local netip.Addr) uint16 {
+	mss, header := defaultMSS, ipv4HeaderLength
+	if local.Is6() {
+		// IPv6の固定ヘッダは40byte (RFC8200 3)
+		mss, header = defaultMSS6, 40
+	}
+	if pio, ok := s.packetIO(local).(mtuPacketIO); ok {
+		if n := pio.MTU() - header - tcpHeaderLength; n > 0 && n <= 0xffff {
+			return uint16(n)
+		}
+	}
+	return uint16(mss)
+}
+
+func (s *Stack) maxRetries() int {
+	if s.MaxRetries > 0 {
+		return s.MaxRetries
+	}
+	return defaultMaxRetries
+}
+
+func (s *Stack) congestionControl() string {
+	if s.CongestionControl != "" {
+		return s.CongestionControl
+	}
+	return defaultCongestionControl
+}
+
+func (s *Stack) removeConn(conn *Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	id := newFourTuple(conn.localIP, conn.localPort, conn.remoteIP, conn.remotePort)
+	if s.conns[id] == conn {
+		delete(s.conns, id)
+		// コネクションのロックを取ったまま呼ばれるのでルールは別のgoroutineで消す
+		s.releaseRSTLater(id.local)
+	}
+}
+
+func (s *Stack) removeListener(ln *Listener) {
+	s.mu.Lock()
+	removed := s.listeners[ln.port] == ln
+	if removed {
+		delete(s.listeners, ln.port)
+	}
+	s.mu.Unlock()
+
+	if removed {
+		for _, local := range ln.localAddrs() {
+			s.releaseRST(netip.AddrPortFrom(local, ln.port))
+		}
+	}
+}
+
+// send はsegをエンコードしてチェックサムを付け、srcからdstへ送る。バッファはプールから借りて送ったら返す
+func (s *Stack) send(src, dst netip.Addr, seg *segment) error {
+	options, err := seg.options.Marshal()
+	if err != nil {
+		return err
+	}
+	wire := seg.wire(options)
+	buf := getPacketBuffer()
+	defer putPacketBuffer(buf)
+
+	if *buf, err = wire.AppendTo(*buf); err != nil {
+		return err
+	}
+	if err := s.putChecksum(*buf, src, dst); err != nil {
+		return err
+	}
+	return s.output(src, dst, *buf)
+}
+
+// output はsrcのアドレスを持つPacketIOからdstへパケットを送る
+func (s *Stack) output(src, dst netip.Addr, packet []byte) error {
+	pio := s.packetIO(src)
+	if pio == nil {
+		return fmt.Errorf("local address %v is not in %v", src, s.Addrs())
+	}
+	return pio.WritePacket(packet, src, dst)
+}
+
+func (s *Stack) readLoop(pio PacketIO) {
+	// ループバックなどMTUの大きいリンクでも切り詰めないように最大長で受ける
+	buf := make([]byte, 65535)
+	var parsed Segment
+	for {
+		n, src, dst, err := pio.ReadPacket(buf)
+		if err != nil {
+			return
+		}
+		// 壊れたセグメントは1つずつログに出さずに捨てる
+		if err := parsed.DecodeFrom(buf[:n]); err != nil {
+			continue
+		}
+		if !s.checkChecksum(buf[:n], src, dst) {
+			continue
+		}
+		seg, err := parsed.segment()
+		if err != nil {
+			continue
+		}
+		// readLoopはbufを使い回すのでデータはコピーしておく
+		seg.data = append([]byte(nil), seg.data...)
+		s.demux(src, dst, seg)
+	}
+}
+
+// demux は受信したセグメントを4タプルでコネクションのキューに振り分ける
+func (s *Stack) demux(srcIP netip.Addr, dstIP netip.Addr, seg segment) {
+	s.mu.Lock()
+	id := newFourTuple(dstIP, seg.dstPort, srcIP, seg.srcPort)
+	conn, ok := s.conns[id]
+	if !ok {
+		// 新しいSYNであれば宛先のアドレスで待ち受けているリスナーに渡す
+		ln, listening := s.listeners[seg.dstPort]
+		listening = listening && ln.accepts(dstIP)
+		if !listening || seg.has(RST) || !seg.has(SYN) || seg.has(ACK) {
+			reset := (listening && seg.has(ACK)) || s.ResetClosedPorts
+			s.mu.Unlock()
+			if reset {
+				s.sendReset(srcIP, dstIP, &seg)
+			}
+			return
+		}
+		conn = s.newPassiveConn(ln, id, srcIP, seg.srcPort)
+		s.mu.Unlock()
+		// リスナーがルールを入れているので数を増やすだけ
+		if err := s.suppressRST(id.local); err != nil {
+			fmt.Printf("suppress rst err : %v\n", err)
+		}
+		conn.enqueue(srcIP, seg)
+		return
+	}
+	s.mu.Unlock()
+
+	conn.enqueue(srcIP, seg)
+}
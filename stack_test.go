@@ -0,0 +1,216 @@
+package rfc9401
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+// pipeStacks はPipeでつないだクライアント(192.0.2.1)とサーバ(192.0.2.2)のStackを返す
+func pipeStacks(t *testing.T) (*Stack, *Stack) {
+	a, b := Pipe(netip.MustParseAddr("192.0.2.1"), netip.MustParseAddr("192.0.2.2"))
+	c, s := NewStack(a), NewStack(b)
+	t.Cleanup(func() { c.Close(); s.Close() })
+	return c, s
+}
+
+// lossyIO はdropがtrueを返したセグメントを送らずに捨てるPacketIO
+type lossyIO struct {
+	PacketIO
+	drop func(seg segment) bool
+}
+
+func (l *lossyIO) WritePacket(b []byte, src, dst netip.Addr) error {
+	var wire Segment
+	if err := wire.DecodeFrom(b); err == nil && l.drop != nil {
+		if seg, err := wire.segment(); err == nil && l.drop(seg) {
+			return nil
+		}
+	}
+	return l.PacketIO.WritePacket(b, src, dst)
+}
+
+// lossyStacks はクライアントの送るセグメントをdropで捨てられるpipeStacks
+func lossyStacks(t *testing.T, drop func(segment) bool) (*Stack, *Stack) {
+	a, b := Pipe(netip.MustParseAddr("192.0.2.1"), netip.MustParseAddr("192.0.2.2"))
+	c, s := NewStack(&lossyIO{PacketIO: a, drop: drop}), NewStack(b)
+	t.Cleanup(func() { c.Close(); s.Close() })
+	return c, s
+}
+
+// echoServer はlnで受けたコネクションのデータをそのまま返す
+func echoServer(ln *Listener) {
+	for {
+		conn, err := ln.AcceptTCP()
+		if err != nil {
+			return
+		}
+		go func() {
+			io.Copy(conn, conn)
+			conn.Close()
+		}()
+	}
+}
+
+func TestEcho(t *testing.T) {
+	c, s := pipeStacks(t)
+	ln, err := s.ListenTCP(&net.TCPAddr{Port: 80})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go echoServer(ln)
+
+	conn, err := c.DialTCP(nil, &net.TCPAddr{IP: net.IP{192, 0, 2, 2}, Port: 80})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	payload := bytes.Repeat([]byte("0123456789"), 100)
+	if _, err := conn.Write(payload); err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, len(payload))
+	if _, err := io.ReadFull(conn, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, payload) {
+		t.Fatalf("echo mismatch : got %q", got)
+	}
+	if err := conn.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// dialPipe はsのポート80で待ち受けてcから接続し、両端のコネクションを返す
+func dialPipe(t *testing.T, c, s *Stack) (*Conn, *Conn) {
+	ln, err := s.ListenTCP(&net.TCPAddr{Port: 80})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	accepted := make(chan *Conn, 1)
+	go func() {
+		conn, _ := ln.AcceptTCP()
+		accepted <- conn
+	}()
+	conn, err := c.DialTCP(nil, &net.TCPAddr{IP: net.IP{192, 0, 2, 2}, Port: 80})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := <-accepted
+	if srv == nil {
+		t.Fatal("listener closed before accept")
+	}
+	return conn, srv
+}
+
+func TestDualStack(t *testing.T) {
+	c4, s4 := Pipe(netip.MustParseAddr("192.0.2.1"), netip.MustParseAddr("192.0.2.2"))
+	c6, s6 := Pipe(netip.MustParseAddr("2001:db8::1"), netip.MustParseAddr("2001:db8::2"))
+	srv, cli := NewStack(s4, s6), NewStack(c4, c6)
+	defer srv.Close()
+	defer cli.Close()
+	ln, err := srv.ListenTCP(&net.TCPAddr{Port: 80})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go echoServer(ln)
+
+	for _, tc := range []struct {
+		raddr string
+		mss   uint16
+	}{
+		{"192.0.2.2:80", defaultMSS},
+		{"[2001:db8::2]:80", defaultMSS6},
+	} {
+		conn, err := cli.DialAddrPort(netip.AddrPort{}, netip.MustParseAddrPort(tc.raddr))
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetDeadline(time.Now().Add(10 * time.Second))
+		if conn.sndMSS != tc.mss {
+			t.Errorf("%s : MSS %d, want %d", tc.raddr, conn.sndMSS, tc.mss)
+		}
+		msg := bytes.Repeat([]byte("v6"), 5000)
+		go conn.Write(msg)
+		buf := make([]byte, len(msg))
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			t.Fatal(tc.raddr, err)
+		}
+		if !bytes.Equal(buf, msg) {
+			t.Fatalf("%s : echo mismatch", tc.raddr)
+		}
+		conn.Close()
+	}
+	_, err = cli.DialAddrPort(netip.MustParseAddrPort("192.0.2.1:0"), netip.MustParseAddrPort("[2001:db8::2]:80"))
+	if err == nil {
+		t.Fatal("dialed an IPv6 address from an IPv4 address")
+	}
+}
+
+// onesComplementSum はbを16bitずつ1の補数和で足して反転する。
+// チェックサムを含めて足したときに0になれば合っている
+func onesComplementSum(b []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(b); i += 2 {
+		sum += uint32(b[i])<<8 | uint32(b[i+1])
+	}
+	if len(b)%2 == 1 {
+		sum += uint32(b[len(b)-1]) << 8
+	}
+	for sum>>16 != 0 {
+		sum = sum&0xffff + sum>>16
+	}
+	return ^uint16(sum)
+}
+
+func TestIPv6Checksum(t *testing.T) {
+	src, dst := netip.MustParseAddr("2001:db8::1"), netip.MustParseAddr("2001:db8::2")
+	seg := Segment{SrcPort: 1, DstPort: 2, Seq: 3, Flags: ACK, Data: []byte("odd")}
+	packet, err := seg.AppendTo(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := PutChecksum(packet, src, dst); err != nil {
+		t.Fatal(err)
+	}
+
+	// RFC8200 8.1の疑似ヘッダ : 送信元、宛先、32bitの長さ、3byteの0とNext Header
+	pseudo := append(src.AsSlice(), dst.AsSlice()...)
+	pseudo = binary.BigEndian.AppendUint32(pseudo, uint32(len(packet)))
+	pseudo = append(pseudo, 0, 0, 0, IPProtocolTCP)
+	if sum := onesComplementSum(append(pseudo, packet...)); sum != 0 {
+		t.Fatalf("checksum is off by %#04x", sum)
+	}
+}
+
+// mtuIO はMTUを知っているPacketIO
+type mtuIO struct {
+	PacketIO
+	mtu int
+}
+
+func (m *mtuIO) MTU() int {
+	return m.mtu
+}
+
+func TestMSSFromMTU(t *testing.T) {
+	a, b := Pipe(netip.MustParseAddr("192.0.2.1"), netip.MustParseAddr("192.0.2.2"))
+	c, s := NewStack(&mtuIO{PacketIO: a, mtu: 1000}), NewStack(b)
+	defer c.Close()
+	defer s.Close()
+	conn, srv := dialPipe(t, c, s)
+
+	// 1000byteからIPv4とTCPのヘッダを引く
+	const want = 1000 - 20 - 20
+	if conn.advMSS() != want {
+		t.Errorf("client advertises MSS %d, want %d", conn.advMSS(), want)
+	}
+	if conn.sndMSS != want || srv.sndMSS != want {
+		t.Errorf("send MSS client %d server %d, want %d", conn.sndMSS, srv.sndMSS, want)
+	}
+}
@@ -0,0 +1,90 @@
+package rfc9401
+
+import (
+	"fmt"
+	"net/netip"
+	"rfc9401/checksum"
+	"sync/atomic"
+)
+
+// ChecksumPolicy はStackが送受信するセグメントのチェックサムをどう扱うか
+type ChecksumPolicy int
+
+const (
+	// ChecksumVerifyLenient は送るときに計算し、受け取ったときに確かめる。
+	// ループバックなどでカーネルが疑似ヘッダの和だけを入れたまま渡してくるもの(CHECKSUM_PARTIAL)は受け入れる
+	ChecksumVerifyLenient ChecksumPolicy = iota
+	// ChecksumVerifyStrict は送るときに計算し、受け取ったときに合わなければすべて捨てる
+	ChecksumVerifyStrict
+	// ChecksumCompute は送るときに計算するだけで、受け取ったものは確かめない
+	ChecksumCompute
+	// ChecksumTrustOffload は下の層がチェックサムを扱うものとして、送るときは疑似ヘッダの和だけを入れ、
+	// 受け取ったものは確かめない。残りを計算してくれるPacketIOのときだけ使うこと
+	ChecksumTrustOffload
+)
+
+func (p ChecksumPolicy) String() string {
+	switch p {
+	case ChecksumVerifyLenient:
+		return "verify-lenient"
+	case ChecksumVerifyStrict:
+		return "verify-strict"
+	case ChecksumCompute:
+		return "compute"
+	case ChecksumTrustOffload:
+		return "trust-offload"
+	}
+	return fmt.Sprintf("ChecksumPolicy(%d)", int(p))
+}
+
+// ChecksumStats は受け取ったセグメントのチェックサムを確かめた結果の数
+type ChecksumStats struct {
+	// Bad は合わずに捨てたセグメントの数
+	Bad uint64
+	// Partial は疑似ヘッダの和だけが入っていたので受け入れたセグメントの数
+	Partial uint64
+}
+
+// checksumCounters はreadLoopから同時に数えるのでatomicにする
+type checksumCounters struct {
+	bad     atomic.Uint64
+	partial atomic.Uint64
+}
+
+// ChecksumStats はこれまでのチェックサムの結果を返す
+func (s *Stack) ChecksumStats() ChecksumStats {
+	return ChecksumStats{
+		Bad:     s.checksums.bad.Load(),
+		Partial: s.checksums.partial.Load(),
+	}
+}
+
+// putChecksum はポリシーに従ってエンコードしたセグメントbにチェックサムを書き込む
+func (s *Stack) putChecksum(b []byte, src, dst netip.Addr) error {
+	if s.ChecksumPolicy == ChecksumTrustOffload {
+		if err := checkHeaderLength(b); err != nil {
+			return err
+		}
+		sum := checksum.Fold(checksum.PseudoHeader(src, dst, IPProtocolTCP, len(b)))
+		b[16], b[17] = byte(sum>>8), byte(sum)
+		return nil
+	}
+	return PutChecksum(b, src, dst)
+}
+
+// checkChecksum はポリシーに従って受け取ったセグメントbのチェックサムを確かめ、受け入れるかを返す
+func (s *Stack) checkChecksum(b []byte, src, dst netip.Addr) bool {
+	switch s.ChecksumPolicy {
+	case ChecksumCompute, ChecksumTrustOffload:
+		return true
+	}
+	if VerifyChecksum(b, src, dst) == nil {
+		return true
+	}
+	if s.ChecksumPolicy == ChecksumVerifyLenient && isPartialChecksum(b, src, dst) {
+		s.checksums.partial.Add(1)
+		return true
+	}
+	s.checksums.bad.Add(1)
+	return false
+}
@@ -0,0 +1,39 @@
+package rfc9401
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+)
+
+func TestChecksumPolicy(t *testing.T) {
+	for _, tc := range []struct {
+		client, server ChecksumPolicy
+		ok             bool
+	}{
+		// 疑似ヘッダの和だけが入ったチェックサムは緩い検証なら受け入れる
+		{ChecksumTrustOffload, ChecksumVerifyLenient, true},
+		{ChecksumTrustOffload, ChecksumTrustOffload, true},
+		{ChecksumTrustOffload, ChecksumVerifyStrict, false},
+		{ChecksumCompute, ChecksumVerifyStrict, true},
+	} {
+		a, b := Pipe(netip.MustParseAddr("192.0.2.1"), netip.MustParseAddr("192.0.2.2"))
+		c, s := NewStack(a), NewStack(b)
+		c.ChecksumPolicy, s.ChecksumPolicy = tc.client, tc.server
+		c.MaxRetries = 1
+		ln, err := s.ListenTCP(&net.TCPAddr{Port: 80})
+		if err != nil {
+			t.Fatal(err)
+		}
+		go ln.Accept()
+		_, err = c.DialTCP(nil, &net.TCPAddr{IP: net.IP{192, 0, 2, 2}, Port: 80})
+		if (err == nil) != tc.ok {
+			t.Errorf("%s -> %s : dial err %v", tc.client, tc.server, err)
+		}
+		if stats := s.ChecksumStats(); (stats.Bad == 0) != tc.ok {
+			t.Errorf("%s -> %s : %+v", tc.client, tc.server, stats)
+		}
+		c.Close()
+		s.Close()
+	}
+}
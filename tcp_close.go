@@ -0,0 +1,67 @@
+package rfc9401
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	// MSL はセグメントがネットワークに残りうる最大の時間。RFC9293では2分だがLinuxと同じくTIME-WAITを60秒にする
+	msl = 30 * time.Second
+	// Closeしたあと相手のFINをFIN-WAIT-2で待つ時間
+	finWait2Timeout = 60 * time.Second
+)
+
+// CloseWrite は送信バッファのデータの後にFINを送り、送信側だけを閉じる。
+// 相手がFINを送ってくるまでReadは続けられる
+func (c *Conn) CloseWrite() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.finQueued {
+		return nil
+	}
+	return c.shutdown()
+}
+
+func (s *Stack) timeWait() time.Duration {
+	if s.TimeWait > 0 {
+		return s.TimeWait
+	}
+	return 2 * msl
+}
+
+// startCloseTimer はTIME-WAITかFIN-WAIT-2を抜けてCLOSEDにするタイマを張り直す
+func (c *Conn) startCloseTimer(d time.Duration) {
+	c.stopCloseTimer()
+	c.closeGeneration++
+	generation := c.closeGeneration
+	c.closeTimer = time.AfterFunc(d, func() {
+		c.onCloseTimeout(generation)
+	})
+}
+
+func (c *Conn) stopCloseTimer() {
+	if c.closeTimer != nil {
+		c.closeTimer.Stop()
+		c.closeTimer = nil
+	}
+}
+
+func (c *Conn) onCloseTimeout(generation uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if generation != c.closeGeneration {
+		return
+	}
+	c.closeTimer = nil
+	switch c.state {
+	case StateTimeWait:
+		c.setState(StateClosed)
+	case StateFinWait2:
+		// 相手がFINを送ってこないまま時間が過ぎた
+		fmt.Println("FIN-WAIT-2 timeout")
+		c.setState(StateClosed)
+	}
+}
@@ -0,0 +1,112 @@
+package rfc9401
+
+import (
+	"io"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestHalfCloseTimeWait(t *testing.T) {
+	c, s := pipeStacks(t)
+	c.TimeWait = 300 * time.Millisecond
+	ln, err := s.ListenTCP(&net.TCPAddr{Port: 80})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		conn, err := ln.AcceptTCP()
+		if err != nil {
+			return
+		}
+		// 相手がCloseWriteするまで読んでから返事をする
+		req, err := io.ReadAll(conn)
+		if err != nil {
+			t.Error(err)
+		}
+		conn.Write(append([]byte("echo:"), req...))
+		conn.Close()
+	}()
+
+	conn, err := c.DialTCP(nil, &net.TCPAddr{IP: net.IP{192, 0, 2, 2}, Port: 80})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	conn.Write([]byte("hello"))
+	if err := conn.CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Write([]byte("x")); err == nil {
+		t.Fatal("write after CloseWrite succeeded")
+	}
+	resp, err := io.ReadAll(conn)
+	if err != nil || string(resp) != "echo:hello" {
+		t.Fatalf("got %q, %v", resp, err)
+	}
+	if err := conn.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if state := conn.State(); state != StateTimeWait {
+		t.Fatalf("client is in %s, want %s", state, StateTimeWait)
+	}
+
+	// TIME-WAITではRSTで閉じない (RFC1337)
+	conn.mu.Lock()
+	rst := segment{srcPort: 80, dstPort: conn.localPort, seq: conn.rcvNxt, flags: RST}
+	conn.mu.Unlock()
+	conn.enqueue(netip.MustParseAddr("192.0.2.2"), rst)
+	time.Sleep(100 * time.Millisecond)
+	if state := conn.State(); state != StateTimeWait {
+		t.Fatalf("TIME-WAIT assassinated : client is in %s", state)
+	}
+
+	time.Sleep(400 * time.Millisecond)
+	if state := conn.State(); state != StateClosed {
+		t.Fatalf("client is in %s after TIME-WAIT, want %s", state, StateClosed)
+	}
+	if _, err := conn.Read(make([]byte, 1)); err != ErrConnClosed {
+		t.Fatalf("got %v, want %v", err, ErrConnClosed)
+	}
+}
+
+func TestTimeWaitFINRetransmit(t *testing.T) {
+	c, s := pipeStacks(t)
+	c.TimeWait = time.Minute
+	conn, srv := dialPipe(t, c, s)
+	if err := conn.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.Close(); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if state := conn.State(); state != StateTimeWait {
+		t.Fatalf("client is in %s, want %s", state, StateTimeWait)
+	}
+
+	// ACKが届かなかったものとしてサーバのFINを送り直す
+	conn.mu.Lock()
+	fin := segment{
+		srcPort: 80,
+		dstPort: conn.localPort,
+		seq:     conn.rcvNxt - 1,
+		ack:     conn.sndNxt,
+		flags:   FIN | ACK,
+		window:  1000,
+		options: TCPOptions{TimestampsOption{Value: conn.tsRecent, EchoReply: conn.tsClock.now()}},
+	}
+	generation := conn.closeGeneration
+	conn.mu.Unlock()
+	conn.handleSegment(netip.MustParseAddr("192.0.2.2"), fin)
+
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	if conn.state != StateTimeWait {
+		t.Fatalf("client is in %s, want %s", conn.state, StateTimeWait)
+	}
+	if conn.closeGeneration == generation {
+		t.Fatal("TIME-WAIT timer was not restarted")
+	}
+}
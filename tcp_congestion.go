@@ -0,0 +1,208 @@
+package rfc9401
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// 重複ACKがこの数だけ来たら高速再送する (RFC5681 3.2)
+const dupAckThreshold = 3
+
+// CongestionControl は輻輳ウィンドウを管理するアルゴリズム。
+// 損失の検出と高速リカバリ中のウィンドウの膨張はConnが行い、
+// アルゴリズムはそれぞれのイベントに対してcwndとssthreshを更新する
+type CongestionControl interface {
+	// Init はコネクションの確立時に送信MSSを渡して初期化する
+	Init(mss uint32)
+	// Window は現在の輻輳ウィンドウをbyteで返す
+	Window() uint32
+	// OnAck はリカバリ中でないときに新しくackedバイトがACKされると呼ばれる。srttは現在の平滑化RTT
+	OnAck(acked uint32, srtt time.Duration)
+	// EnterRecovery は重複ACKで損失を検出して高速再送するときに呼ばれる
+	EnterRecovery(inFlight uint32)
+	// ExitRecovery はリカバリを始めたときに送っていたデータがすべてACKされると呼ばれる
+	ExitRecovery()
+	// OnTimeout は再送タイマが切れたときに呼ばれる
+	OnTimeout(inFlight uint32)
+}
+
+var (
+	congestionControlsMu sync.RWMutex
+	congestionControls   = map[string]func() CongestionControl{
+		"newreno": func() CongestionControl { return &NewReno{} },
+		"cubic":   func() CongestionControl { return &Cubic{} },
+	}
+)
+
+// デフォルトの輻輳制御アルゴリズム
+const defaultCongestionControl = "newreno"
+
+// RegisterCongestionControl はnameで選べる輻輳制御アルゴリズムを登録する
+func RegisterCongestionControl(name string, newFunc func() CongestionControl) {
+	congestionControlsMu.Lock()
+	defer congestionControlsMu.Unlock()
+	congestionControls[name] = newFunc
+}
+
+// CongestionControls は登録されているアルゴリズムの名前を返す
+func CongestionControls() []string {
+	congestionControlsMu.RLock()
+	defer congestionControlsMu.RUnlock()
+
+	names := make([]string, 0, len(congestionControls))
+	for name := range congestionControls {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func newCongestionControl(name string) (CongestionControl, error) {
+	if name == "" {
+		name = defaultCongestionControl
+	}
+	congestionControlsMu.RLock()
+	newFunc, ok := congestionControls[name]
+	congestionControlsMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown congestion control : %s", name)
+	}
+	return newFunc(), nil
+}
+
+// initialWindow はRFC5681 3.1の初期ウィンドウを返す
+func initialWindow(mss uint32) uint32 {
+	switch {
+	case mss > 2190:
+		return 2 * mss
+	case mss > 1095:
+		return 3 * mss
+	default:
+		return 4 * mss
+	}
+}
+
+// SetCongestionControl はこのコネクションで使う輻輳制御アルゴリズムを切り替える
+func (c *Conn) SetCongestionControl(name string) error {
+	cc, err := newCongestionControl(name)
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	cc.Init(uint32(c.sndMSS))
+	c.cc = cc
+	c.ccName = name
+	return nil
+}
+
+// CongestionControl はこのコネクションで使っている輻輳制御アルゴリズムの名前を返す
+func (c *Conn) CongestionControl() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.ccName
+}
+
+// congestionWindow は高速リカバリ中の膨張分を含めた輻輳ウィンドウを返す
+func (c *Conn) congestionWindow() uint32 {
+	wnd := int64(c.cc.Window()) + c.inflation
+	if wnd < int64(c.sndMSS) {
+		wnd = int64(c.sndMSS)
+	}
+	return uint32(wnd)
+}
+
+// onNewAck は新しいデータがACKされたときにリカバリの状態と輻輳ウィンドウを更新する (RFC6582 3.2)
+func (c *Conn) onNewAck(acked uint32) {
+	c.dupAcks = 0
+	if !c.inRecovery {
+		c.cc.OnAck(acked, c.rto.srtt)
+		return
+	}
+
+	if seqGE(c.sndUna, c.recover) {
+		// Full ACK。リカバリを抜ける
+		c.inRecovery = false
+		c.inflation = 0
+		if !c.rtoRecovery {
+			c.cc.ExitRecovery()
+		}
+		c.rtoRecovery = false
+		return
+	}
+
+	if c.sackRecovering() {
+		// Partial ACK。SACKの情報から失われたセグメントを再送する
+		c.sackRetransmit(false)
+		return
+	}
+	// Partial ACK。次に失われているセグメントを再送し、ACKされた分だけウィンドウを縮める
+	if len(c.rtxQueue) > 0 {
+		c.retransmitHead()
+	}
+	if !c.rtoRecovery {
+		c.inflation -= int64(acked)
+		if acked >= uint32(c.sndMSS) {
+			c.inflation += int64(c.sndMSS)
+		}
+	}
+}
+
+// isDupAck はRFC5681 2の重複ACKかどうかを判定する
+func (c *Conn) isDupAck(seg *segment) bool {
+	return seg.ack == c.sndUna &&
+		c.sndUna != c.sndNxt &&
+		len(seg.data) == 0 &&
+		!seg.has(SYN) && !seg.has(FIN) &&
+		uint32(seg.window)<<c.sndWndShift == c.sndWnd
+}
+
+// onDupAck は重複ACKを数え、3つ目で高速再送して高速リカバリに入る (RFC5681 3.2, RFC6582 3.2)
+func (c *Conn) onDupAck() {
+	c.dupAcks++
+	if c.sackRecovering() {
+		c.sackRetransmit(false)
+		return
+	}
+	if c.inRecovery {
+		if !c.rtoRecovery {
+			// 重複ACKの分だけ1セグメントずつウィンドウを膨らませる
+			c.inflation += int64(c.sndMSS)
+		}
+		return
+	}
+	// SACKが有効なら重複ACKが足りなくても先頭のセグメントが失われたとわかればリカバリに入る (RFC6675 5)
+	lost := c.dupAcks == dupAckThreshold || (c.sackEnabled && len(c.rtxQueue) > 0 && c.lostSegments()[0])
+	// 前回のリカバリで送ったデータへの重複ACKでは再びリカバリに入らない
+	if !lost || (c.recoverValid && !seqGT(c.sndUna, c.recover)) {
+		return
+	}
+
+	fmt.Println("Fast retransmit")
+	c.inRecovery = true
+	c.recover = c.sndNxt
+	c.recoverValid = true
+	c.cc.EnterRecovery(c.sndNxt - c.sndUna)
+	if c.sackEnabled {
+		c.enterSACKRecovery()
+		return
+	}
+	c.inflation = int64(dupAckThreshold) * int64(c.sndMSS)
+	c.retransmitHead()
+}
+
+// onTimeoutCongestion は再送タイムアウトで輻輳ウィンドウを縮め、
+// それまでに送ったデータがACKされるまでPartial ACKごとに再送する
+func (c *Conn) onTimeoutCongestion() {
+	c.cc.OnTimeout(c.sndNxt - c.sndUna)
+	c.clearScoreboard()
+	c.dupAcks = 0
+	c.inflation = 0
+	c.inRecovery = true
+	c.rtoRecovery = true
+	c.recover = c.sndNxt
+	c.recoverValid = true
+}
@@ -0,0 +1,110 @@
+package rfc9401
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// sinkServer はlnで受けた最初のコネクションから読んだデータをすべてdoneに送る
+func sinkServer(ln *Listener, done chan<- []byte) {
+	conn, err := ln.AcceptTCP()
+	if err != nil {
+		return
+	}
+	b, _ := io.ReadAll(conn)
+	done <- b
+	conn.Close()
+}
+
+func TestFastRetransmit(t *testing.T) {
+	n := 0
+	c, s := lossyStacks(t, func(seg segment) bool {
+		if len(seg.data) > 0 {
+			n++
+			return n == 3
+		}
+		return false
+	})
+	ln, err := s.ListenTCP(&net.TCPAddr{Port: 80})
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan []byte)
+	go sinkServer(ln, done)
+
+	conn, err := c.DialTCP(nil, &net.TCPAddr{IP: net.IP{192, 0, 2, 2}, Port: 80})
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	payload := bytes.Repeat([]byte("x"), 100000)
+	conn.Write(payload)
+	conn.Close()
+	if got := <-done; !bytes.Equal(got, payload) {
+		t.Fatalf("received %d bytes, want %d", len(got), len(payload))
+	}
+	// 再送タイマを待たずに重複ACKで再送する
+	if elapsed := time.Since(start); elapsed > 900*time.Millisecond {
+		t.Fatalf("took %v", elapsed)
+	}
+}
+
+func TestCubic(t *testing.T) {
+	c, s := pipeStacks(t)
+	c.CongestionControl = "cubic"
+	ln, err := s.ListenTCP(&net.TCPAddr{Port: 80})
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan []byte)
+	go sinkServer(ln, done)
+
+	conn, err := c.DialTCP(nil, &net.TCPAddr{IP: net.IP{192, 0, 2, 2}, Port: 80})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name := conn.CongestionControl(); name != "cubic" {
+		t.Fatalf("got %q, want cubic", name)
+	}
+	payload := bytes.Repeat([]byte("y"), 300000)
+	conn.Write(payload)
+	conn.Close()
+	if got := <-done; !bytes.Equal(got, payload) {
+		t.Fatalf("received %d bytes, want %d", len(got), len(payload))
+	}
+}
+
+func TestUnknownCongestionControl(t *testing.T) {
+	c, s := pipeStacks(t)
+	c.CongestionControl = "unknown"
+	if _, err := c.DialTCP(nil, &net.TCPAddr{IP: net.IP{192, 0, 2, 2}, Port: 80}); err == nil {
+		t.Fatal("dialed with an unknown congestion control")
+	}
+	s.CongestionControl = "unknown"
+	if _, err := s.ListenTCP(&net.TCPAddr{Port: 80}); err == nil {
+		t.Fatal("listened with an unknown congestion control")
+	}
+
+	// Listenの後に変わったときは実際に使うアルゴリズムの名前を返す
+	s.CongestionControl = ""
+	c.CongestionControl = ""
+	ln, err := s.ListenTCP(&net.TCPAddr{Port: 80})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.CongestionControl = "unknown"
+	accepted := make(chan *Conn, 1)
+	go func() {
+		conn, _ := ln.AcceptTCP()
+		accepted <- conn
+	}()
+	if _, err := c.DialTCP(nil, &net.TCPAddr{IP: net.IP{192, 0, 2, 2}, Port: 80}); err != nil {
+		t.Fatal(err)
+	}
+	if name := (<-accepted).CongestionControl(); name != defaultCongestionControl {
+		t.Fatalf("got %q, want %q", name, defaultCongestionControl)
+	}
+}
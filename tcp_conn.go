@@ -1,200 +1,871 @@
 package rfc9401
 
 import (
+	"errors"
 	"fmt"
-	"log"
+	"io"
 	"net"
+	"net/netip"
+	"os"
+	"sync"
+	"time"
 )
 
-//const clientPort = 37738
+const (
+	NETWORK_STR  = "ip:tcp"
+	NETWORK6_STR = "ip6:tcp"
+)
+
+const (
+	// SYNで広告するMSS。IPv4とTCPのヘッダを除いたイーサネットのMTU
+	defaultMSS = 1460
+	// IPv6のヘッダはIPv4より20byte長い
+	defaultMSS6 = 1440
+	// 相手がMSSオプションを送ってこなかったときに使うMSS (RFC9293 3.7.1)
+	defaultSendMSS = 536
+	// IPv6の最小MTUの1280からヘッダを除いたもの (RFC8200 5)
+	defaultSendMSS6 = 1220
+	// 処理待ちの受信セグメントの最大数
+	inboxSize = 256
+)
 
-const NETWORK_STR = "ip:tcp"
+var ErrConnClosed = errors.New("connection closed")
 
-type TcpState struct {
-	tcpHeader TCPHeader
-	tcpData   []byte
-	err       error
-}
+var _ net.Conn = (*Conn)(nil)
+
+// Conn はRFC9293のステートマシンを持つTCPコネクション
+type Conn struct {
+	mu    sync.Mutex
+	state ConnState
+	// 状態が変わるたびにcloseして作り直し、待っているgoroutineを起こす
+	event chan struct{}
+
+	localIP    netip.Addr
+	remoteIP   netip.Addr
+	localPort  uint16
+	remotePort uint16
+
+	// 送信シーケンス変数
+	iss    uint32
+	sndUna uint32
+	sndNxt uint32
+	sndWnd uint32
+	sndWl1 uint32
+	sndWl2 uint32
+	// 相手がこれまでに広告した最大のウィンドウ
+	maxSndWnd uint32
+	// 相手に送れるセグメントの最大データ長
+	sndMSS uint16
+	// 受信シーケンス変数
+	irs    uint32
+	rcvNxt uint32
+	// 広告した受信ウィンドウの右端
+	rcvAdv uint32
+	// Window Scaleのシフト数
+	sndWndShift uint8
+	rcvWndShift uint8
+	wsEnabled   bool
 
-func Dial(clientAddr string, serverAddr string, serverpPort int) (TCPHeader, error) {
+	// まだ送っていないデータ
+	sndQueue []byte
+	// CloseかCloseWriteされたので送信バッファを送り終わったらFINを送る
+	finQueued bool
+	// Closeされたのでもう読み書きしない
+	userClosed bool
+	// TIME-WAITとFIN-WAIT-2を抜けるタイマ
+	closeTimer      *time.Timer
+	closeGeneration uint64
+	// ゼロウィンドウプローブのタイマ
+	persistTimer      *time.Timer
+	persistGeneration uint64
 
-	clientPort := getRandomClientPort()
+	recvBuf []byte
+	// 順番より先に届いたデータ
+	reasm reassembler
+	// 相手からFINを受信したか
+	finRecv bool
+	// 自分がFINを送信したか
+	finSent bool
+	// 死亡フラグのポリシーと、送ったデータ(受け取った死亡フラグ)のセグメントの数
+	dthPolicy DeathFlagPolicy
+	dthSent   int
+	dthRecv   int
+	// dthWrites はWriteが呼ばれた回数、dthWriteMarks はまだ送り終えていないWriteのデータの終わり
+	dthWrites     int
+	dthWriteMarks []writeMark
+	dthEvents     chan DeathFlagEvent
+	err           error
 
-	chHeader := make(chan TcpState)
-	go func() {
-		Listen(serverAddr, clientPort, chHeader)
-	}()
+	readDeadline  time.Time
+	writeDeadline time.Time
 
-	conn, err := net.Dial(NETWORK_STR, serverAddr)
+	// 再送キューとタイマ
+	rtxQueue      []*txSegment
+	rtxTimer      *time.Timer
+	rtxGeneration uint64
+	retries       int
+	rto           rtoEstimator
+
+	// 輻輳制御
+	cc     CongestionControl
+	ccName string
+	// 高速リカバリの状態 (RFC6582)
+	dupAcks      int
+	inRecovery   bool
+	rtoRecovery  bool
+	recover      uint32
+	recoverValid bool
+	// 高速リカバリ中に重複ACKの分だけ膨らませた輻輳ウィンドウ
+	inflation int64
+	// 両方のSYNにSACK Permittedがあった
+	sackEnabled bool
+
+	// Timestampsオプション (RFC7323)
+	tsEnabled   bool
+	tsClock     tsClock
+	tsRecent    uint32
+	tsRecentAge time.Time
+	lastAckSent uint32
+
+	stack *Stack
+	// Stackから振り分けられた受信セグメント
+	inbox chan inbound
+	// CLOSEDになったらcloseされる
+	done chan struct{}
+	// listener は受動オープンしたときのリスナー。能動オープンではnil
+	listener *Listener
+}
+
+type inbound struct {
+	srcIP netip.Addr
+	seg   segment
+}
+
+func newConn(stack *Stack, localIP netip.Addr, localPort uint16) *Conn {
+	ccName := stack.congestionControl()
+	cc, err := newCongestionControl(ccName)
 	if err != nil {
-		return TCPHeader{}, err
-	}
-	defer conn.Close()
-
-	// SYNパケットを作る
-	syn := TCPHeader{
-		TCPDummyHeader: tcpDummyHeader{
-			SourceIP: ipv4ToByte(clientAddr),
-			DestIP:   ipv4ToByte(serverAddr),
-		},
-		SourcePort:    uint16ToByte(uint16(clientPort)),
-		DestPort:      uint16ToByte(uint16(serverpPort)),
-		SeqNumber:     uint32ToByte(209828892),
-		AckNumber:     uint32ToByte(0),
-		DataOffset:    20,
-		DTH:           0,
-		Reserved:      0,
-		TCPCtrlFlags:  tcpCtrlFlags{SYN: 1},
-		WindowSize:    uint16ToByte(65495),
-		Checksum:      uint16ToByte(0),
-		UrgentPointer: uint16ToByte(0),
+		// DialとListenで名前を確かめているので、Listenの後にStackの設定が変わったときだけここに来る
+		fmt.Printf("%v, use %s\n", err, defaultCongestionControl)
+		ccName = defaultCongestionControl
+		cc, _ = newCongestionControl(ccName)
+	}
+	conn := &Conn{
+		state:     StateClosed,
+		event:     make(chan struct{}),
+		localIP:   localIP,
+		localPort: localPort,
+		sndMSS:    defaultSendMSS,
+		rto:       newRTOEstimator(),
+		tsClock:   newTSClock(),
+		cc:        cc,
+		ccName:    ccName,
+		dthPolicy: stack.DeathFlagPolicy,
+		dthEvents: make(chan DeathFlagEvent, deathFlagEventsSize),
+		stack:     stack,
+		inbox:     make(chan inbound, inboxSize),
+		done:      make(chan struct{}),
 	}
+	conn.cc.Init(uint32(conn.sndMSS))
+	go conn.processLoop()
 
-	// SYNパケットを送る
-	_, err = conn.Write(syn.toPacket())
+	return conn
+}
+
+// Dial はSYNを送ってコネクションを確立する(Active Open)
+func Dial(clientAddr string, serverAddr string, serverpPort int) (*Conn, error) {
+	return DialTCP(&net.TCPAddr{IP: net.ParseIP(clientAddr)},
+		&net.TCPAddr{IP: net.ParseIP(serverAddr), Port: serverpPort})
+}
+
+// DialTCP はladdrからraddrへコネクションを確立する。
+// laddrがnilの場合はraddrへの経路から送信元アドレスを決め、Portが0の場合はランダムに選ぶ
+func DialTCP(laddr, raddr *net.TCPAddr) (*Conn, error) {
+	if raddr == nil {
+		return nil, fmt.Errorf("invalid remote address : %v", raddr)
+	}
+	remote := tcpAddrPort(raddr)
+	if !remote.Addr().IsValid() {
+		return nil, fmt.Errorf("invalid remote address : %v", raddr)
+	}
+	var local netip.AddrPort
+	if laddr != nil {
+		local = tcpAddrPort(laddr)
+	}
+	if !local.Addr().IsValid() || local.Addr().IsUnspecified() {
+		ip, err := localIPFor(remote.Addr())
+		if err != nil {
+			return nil, err
+		}
+		local = netip.AddrPortFrom(ip, local.Port())
+	}
+	stack, err := defaultStack(local.Addr())
 	if err != nil {
-		return TCPHeader{}, fmt.Errorf("SYN Packet Send error : %s", err)
+		return nil, err
 	}
+	return stack.DialAddrPort(local, remote)
+}
 
+// connect はSYNを送り、コネクションが確立するまで待つ
+func (c *Conn) connect() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.iss = c.generateISN()
+	c.sndUna = c.iss
+	c.sndNxt = c.iss + 1
+	c.setState(StateSynSent)
+	// SYNパケットを送る
+	if err := c.transmit(c.iss, SYN, nil); err != nil {
+		c.setState(StateClosed)
+		return fmt.Errorf("SYN Packet Send error : %s", err)
+	}
 	fmt.Println("Send SYN Packet")
-	// SYNACKに対して受信したACKを受ける
-	result := <-chHeader
-	if result.err != nil {
-		return TCPHeader{}, result.err
+
+	// SYNACKを受けてACKを返すまで待つ
+	for c.state != StateEstablished {
+		if err := c.checkErr(); err != nil {
+			return err
+		}
+		c.wait(time.Time{})
 	}
 
-	return result.tcpHeader, nil
+	return nil
 }
 
-func Listen(listenAddr string, port int, chHeader chan TcpState) error {
-	conn, err := net.ListenPacket(NETWORK_STR, listenAddr)
+// localIPFor はdstに送るときに使われる自分のIPアドレスを返す
+func localIPFor(dst netip.Addr) (netip.Addr, error) {
+	// UDPはconnectしてもパケットを送らないので経路の確認だけに使える
+	udp, err := net.Dial("udp", netip.AddrPortFrom(dst, 9).String())
 	if err != nil {
-		log.Fatalf("Listen is err : %v", err)
+		return netip.Addr{}, err
 	}
-	defer conn.Close()
+	defer udp.Close()
+	local := udp.LocalAddr().(*net.UDPAddr).AddrPort().Addr()
+	return local.Unmap(), nil
+}
+
+// State は現在のコネクションの状態を返す
+func (c *Conn) State() ConnState {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.state
+}
+
+// LocalAddr は自分のアドレスを返す
+func (c *Conn) LocalAddr() net.Addr {
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(c.localIP, c.localPort))
+}
 
+// RemoteAddr は相手のアドレスを返す
+func (c *Conn) RemoteAddr() net.Addr {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(c.remoteIP, c.remotePort))
+}
+
+// SetDeadline はReadとWriteのデッドラインを設定する
+func (c *Conn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readDeadline = t
+	c.writeDeadline = t
+	c.wakeup()
+	return nil
+}
+
+// SetReadDeadline はReadのデッドラインを設定する
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readDeadline = t
+	c.wakeup()
+	return nil
+}
+
+// SetWriteDeadline はWriteのデッドラインを設定する
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.writeDeadline = t
+	c.wakeup()
+	return nil
+}
+
+// Read は受信したデータを読み出す。相手からFINを受けて読み切ったらio.EOFを返す
+func (c *Conn) Read(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(b) == 0 && !c.userClosed {
+		return 0, nil
+	}
 	for {
-		buf := make([]byte, 1500)
-		n, clientAddr, err := conn.ReadFrom(buf)
-		if err != nil {
+		// 待っている間にCloseされたら、残りのデータがあっても読ませない
+		if c.userClosed {
+			return 0, ErrConnClosed
+		}
+		if len(c.recvBuf) > 0 {
+			n := copy(b, c.recvBuf)
+			c.recvBuf = c.recvBuf[n:]
+			c.updateReceiveWindow()
+			return n, nil
+		}
+		if c.finRecv {
+			return 0, io.EOF
+		}
+		if err := c.checkErr(); err != nil {
+			return 0, err
+		}
+		if err := c.wait(c.readDeadline); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// Write はデータを送信バッファに入れ、相手のウィンドウに収まる分から送る。
+// 送信バッファがいっぱいの場合は空くまで待つ
+func (c *Conn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	written := 0
+	if len(b) > 0 {
+		c.dthWrites++
+	}
+	for written < len(b) {
+		if c.state != StateEstablished && c.state != StateCloseWait {
+			return written, fmt.Errorf("write in %s state", c.state)
+		}
+		if err := c.checkErr(); err != nil {
+			return written, err
+		}
+		space := sendBufferSize - len(c.sndQueue)
+		if space <= 0 {
+			if err := c.wait(c.writeDeadline); err != nil {
+				return written, err
+			}
+			continue
+		}
+		if space > len(b)-written {
+			space = len(b) - written
+		}
+		c.sndQueue = append(c.sndQueue, b[written:written+space]...)
+		c.markWrite(c.dthWrites)
+		written += space
+		c.output()
+	}
+
+	return written, nil
+}
+
+// Close は送信バッファのデータを送り終えてからFINを送り、相手からACKが返るまで待つ。
+// CloseWriteのあとであればFINのACKを待つだけにする。
+// その後は相手のFINを受けてTIME-WAITを過ぎるか、FIN-WAIT-2のまま時間が過ぎるとCLOSEDになる。
+// 相手が応答しないときは再送を諦めるまで(デフォルトでは数分)戻らないので、
+// 待つ時間を決めたいときはSetWriteDeadlineかSetDeadlineを呼んでおく。
+// デッドラインを過ぎて戻ったあともFINの再送は続く
+func (c *Conn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	switch c.state {
+	case StateListen, StateSynSent:
+		c.setState(StateClosed)
+		return nil
+	}
+	if c.userClosed {
+		return ErrConnClosed
+	}
+	if !c.finQueued {
+		if err := c.shutdown(); err != nil {
+			return err
+		}
+	}
+	c.userClosed = true
+	// 状態が変わらなくてもReadで待っているgoroutineを起こす
+	c.wakeup()
+	if c.state == StateFinWait2 {
+		c.startCloseTimer(finWait2Timeout)
+	}
+
+	for !c.finSent || seqLT(c.sndUna, c.sndNxt) {
+		if c.state == StateClosed {
+			return nil
+		}
+		if err := c.checkErr(); err != nil {
 			return err
 		}
-		tcp := parseTCPHeader(buf[:n], clientAddr.String(), listenAddr)
-		// 宛先ポートがクライアントのソースポートであれば
-		if byteToUint16(tcp.DestPort) == uint16(port) {
-			// fmt.Printf("tcp header is %+v\n", tcp)
-			handleTCPConnection(conn, tcp, conn.LocalAddr(), port, chHeader)
+		if err := c.wait(c.writeDeadline); err != nil {
+			return err
 		}
 	}
+
+	return nil
 }
 
-func handleTCPConnection(pconn net.PacketConn, tcpHeader TCPHeader, client net.Addr, port int, ch chan TcpState) {
+// shutdown は送信バッファのデータの後にFINを送るようにしてFIN-WAIT-1かLAST-ACKに移る
+func (c *Conn) shutdown() error {
+	switch c.state {
+	case StateSynReceived, StateEstablished:
+		c.setState(StateFinWait1)
+	case StateCloseWait:
+		c.setState(StateLastAck)
+	default:
+		return fmt.Errorf("close in %s state", c.state)
+	}
+	c.finQueued = true
+	c.output()
+	return nil
+}
 
-	switch tcpHeader.TCPCtrlFlags.getState() {
-	case SYN:
-		fmt.Println("receive SYN packet")
-		tcpHeader.DestPort = tcpHeader.SourcePort
-		tcpHeader.SourcePort = uint16ToByte(uint16(port))
-		tcpHeader.AckNumber = addAckNumber(tcpHeader.SeqNumber, 1)
-		tcpHeader.SeqNumber = uint32ToByte(2142718385)
-		tcpHeader.DataOffset = 20
-		tcpHeader.TCPCtrlFlags.ACK = 1
-		// SYNACKパケットを送信
-		_, err := pconn.WriteTo(tcpHeader.toPacket(), client)
-		if err != nil {
-			log.Fatal(" Write SYNACK is err : %v\n", err)
+// wait はロックを外して状態が変わるかdeadlineを過ぎるまで待つ。呼び出し時はロックを取っていること
+func (c *Conn) wait(deadline time.Time) error {
+	ch := c.event
+	if deadline.IsZero() {
+		c.mu.Unlock()
+		<-ch
+		c.mu.Lock()
+		return nil
+	}
+
+	d := time.Until(deadline)
+	if d <= 0 {
+		return os.ErrDeadlineExceeded
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	c.mu.Unlock()
+	select {
+	case <-ch:
+	case <-timer.C:
+	}
+	c.mu.Lock()
+	return nil
+}
+
+// wakeup は待っているgoroutineをすべて起こす
+func (c *Conn) wakeup() {
+	close(c.event)
+	c.event = make(chan struct{})
+}
+
+func (c *Conn) checkErr() error {
+	if c.err != nil {
+		return c.err
+	}
+	if c.state == StateClosed {
+		return ErrConnClosed
+	}
+	return nil
+}
+
+func (c *Conn) setState(state ConnState) {
+	c.state = state
+	switch state {
+	case StateEstablished:
+		c.cc.Init(uint32(c.sndMSS))
+		if c.listener != nil {
+			c.listener.enqueue(c)
 		}
-		fmt.Println("Send SYNACK packet, wait ACK Packet...")
-	case SYN + ACK:
-		fmt.Println("Recv SYNACK packet")
-		tcpHeader.DestPort = tcpHeader.SourcePort
-		tcpHeader.SourcePort = uint16ToByte(uint16(port))
-		// ACKをいったん保存
-		tmpack := tcpHeader.AckNumber
-		// ACKに
-		tcpHeader.AckNumber = addAckNumber(tcpHeader.SeqNumber, 1)
-		tcpHeader.SeqNumber = tmpack
-		// Option+12byte
-		tcpHeader.DataOffset = 20
-		tcpHeader.TCPCtrlFlags.SYN = 0
-		// ACKパケットを送信
-		_, err := pconn.WriteTo(tcpHeader.toPacket(), client)
-		if err != nil {
-			ch <- TcpState{tcpHeader: TCPHeader{}, err: fmt.Errorf("Send SYNACK err: %v", err)}
+	case StateClosed:
+		c.stopRetransmitTimer()
+		c.stopPersistTimer()
+		c.stopCloseTimer()
+		close(c.done)
+		close(c.dthEvents)
+		c.stack.removeConn(c)
+		if c.listener != nil {
+			c.listener.forget(c)
 		}
-		fmt.Println("Send ACK Packet")
-		// ACKまできたのでchannelで一度返す
-		ch <- TcpState{tcpHeader: tcpHeader, err: nil}
-	case PSH + ACK:
-		fmt.Println("Recv PSHACK packet")
-		var tcpdata []byte
-		var isexistTCPData bool
-		if tcpHeader.Data != nil {
-			isexistTCPData = true
-			tcpdata = tcpHeader.Data
-		}
-		tcpHeader.DestPort = tcpHeader.SourcePort
-		tcpHeader.SourcePort = uint16ToByte(uint16(port))
-		// ACKをいったん保存
-		tmpack := tcpHeader.AckNumber
-		// ACKに
-		tcpHeader.AckNumber = addAckNumber(tcpHeader.SeqNumber, uint32(len(tcpHeader.Data)))
-		tcpHeader.SeqNumber = tmpack
-		tcpHeader.DataOffset = 20
-		tcpHeader.TCPCtrlFlags.PSH = 0
-		tcpHeader.Data = nil
-		// ACKパケットを送信
-		_, err := pconn.WriteTo(tcpHeader.toPacket(), client)
-		if err != nil {
-			ch <- TcpState{tcpHeader: TCPHeader{}, err: fmt.Errorf("Send SYNACK err: %v", err)}
+	case StateFinWait2:
+		// Closeされていれば相手がFINを送ってこなくても閉じられるようにする
+		if c.userClosed {
+			c.startCloseTimer(finWait2Timeout)
 		}
-		fmt.Println("Send ACK to PSHACK Packet")
-		// TCPのデータがなければACKを送ったのでchannelで返す
-		if !isexistTCPData {
-			ch <- TcpState{tcpHeader: tcpHeader, err: nil}
-		} else {
-			if port == int(byteToUint16(tcpHeader.SourcePort)) && port == 18000 {
-				fmt.Println("Send PSHACK Packet From server")
-				// サーバならHTTPレスポンスを返す
-				tcpHeader.DTH = 1
-				resultHeader, _, err := tcpHeader.Write(CreateHttpResp("もう何も怖くない\n"), true)
-				if err != nil {
-					ch <- TcpState{tcpHeader: TCPHeader{}, err: err}
-				}
-				ch <- TcpState{tcpHeader: resultHeader, err: nil}
-			} else {
-				ch <- TcpState{tcpHeader: tcpHeader, tcpData: tcpdata, err: nil}
-			}
+	case StateTimeWait:
+		c.startCloseTimer(c.stack.timeWait())
+	}
+	c.wakeup()
+}
+
+func (c *Conn) sendSegment(seq uint32, flags uint8, data []byte) error {
+	return c.writeSegment(seq, flags, data, false)
+}
 
+// writeSegment はセグメントを組み立てて送る。dthがtrueなら死亡フラグを立てる
+func (c *Conn) writeSegment(seq uint32, flags uint8, data []byte, dth bool) error {
+	seg := segment{
+		srcPort: c.localPort,
+		dstPort: c.remotePort,
+		seq:     seq,
+		flags:   flags,
+		data:    data,
+		dth:     dth,
+	}
+	if flags&ACK != 0 {
+		seg.ack = c.rcvNxt
+		c.lastAckSent = seg.ack
+	}
+	if flags&SYN != 0 {
+		// SYNのウィンドウはスケールしない
+		wnd := receiveBufferSize - len(c.recvBuf)
+		if wnd > 0xffff {
+			wnd = 0xffff
 		}
-	case FIN + ACK:
-		fmt.Println("Recv FINACK packet")
-		tcpHeader.DestPort = tcpHeader.SourcePort
-		tcpHeader.SourcePort = uint16ToByte(uint16(port))
-		// ACKをいったん保存
-		tmpack := tcpHeader.AckNumber
-		// ACKにSEQを
-		tcpHeader.AckNumber = addAckNumber(tcpHeader.SeqNumber, 1)
-		// SEQにACKを
-		tcpHeader.SeqNumber = tmpack
-		tcpHeader.DataOffset = 20
-		tcpHeader.TCPCtrlFlags.FIN = 0
-		// ACKパケットを送信
-		_, err := pconn.WriteTo(tcpHeader.toPacket(), client)
-		if err != nil {
-			ch <- TcpState{tcpHeader: TCPHeader{}, err: fmt.Errorf("Send SYNACK err: %v", err)}
+		seg.window = uint16(wnd)
+		if flags&ACK != 0 {
+			c.rcvAdv = c.rcvNxt + uint32(wnd)
+		}
+		seg.options = append(seg.options, MSSOption{Value: c.advMSS()})
+		// 能動オープンでは必ず、受動オープンでは相手が送ってきたときだけつける
+		if flags&ACK == 0 || c.wsEnabled {
+			seg.options = append(seg.options, NoOperationOption{}, WindowScaleOption{ShiftCount: windowShiftFor(receiveBufferSize)})
+		}
+		if flags&ACK == 0 || c.sackEnabled {
+			seg.options = append(seg.options, NoOperationOption{}, NoOperationOption{}, SACKPermittedOption{})
+		}
+		if flags&ACK == 0 || c.tsEnabled {
+			c.addTimestampsOption(&seg)
+		}
+	} else {
+		seg.window = uint16(c.advertiseWindow() >> c.rcvWndShift)
+		if c.tsEnabled {
+			c.addTimestampsOption(&seg)
+		}
+		c.addSACKOption(&seg)
+	}
+	return c.stack.send(c.localIP, c.remoteIP, &seg)
+}
+
+func (c *Conn) sendAck() {
+	if err := c.sendSegment(c.sndNxt, ACK, nil); err != nil {
+		c.err = fmt.Errorf("send ack err : %v", err)
+	}
+}
+
+// abort はエラーを設定してコネクションを破棄する
+func (c *Conn) abort(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.state == StateClosed {
+		return
+	}
+	c.reset(err)
+}
+
+// enqueue は受信したセグメントをキューに入れる。いっぱいであれば捨てる
+func (c *Conn) enqueue(srcIP netip.Addr, seg segment) {
+	select {
+	case c.inbox <- inbound{srcIP: srcIP, seg: seg}:
+	case <-c.done:
+	default:
+	}
+}
+
+func (c *Conn) processLoop() {
+	for {
+		select {
+		case in := <-c.inbox:
+			c.handleSegment(in.srcIP, in.seg)
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// handleSegment はRFC9293 3.10.7に従って受信したセグメントを処理する
+func (c *Conn) handleSegment(srcIP netip.Addr, seg segment) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	switch c.state {
+	case StateClosed:
+		return
+	case StateListen:
+		c.handleListen(srcIP, seg)
+		return
+	case StateSynSent:
+		if seg.srcPort == c.remotePort && srcIP == c.remoteIP {
+			c.handleSynSent(seg)
+		}
+		return
+	}
+
+	// 別のコネクションのセグメントは無視する
+	if seg.srcPort != c.remotePort || srcIP != c.remoteIP {
+		return
+	}
+	if seg.has(RST) {
+		if c.state == StateTimeWait {
+			// TIME-WAITをRSTで閉じると、古いセグメントが同じ4タプルの新しいコネクションに紛れ込むので無視する (RFC1337)
+			fmt.Println("Ignore RST in TIME-WAIT")
+			return
+		}
+		c.handleReset(&seg)
+		return
+	}
+	if seg.has(SYN) {
+		if c.state == StateSynReceived && seg.seq == c.irs && len(c.rtxQueue) > 0 {
+			// SYNACKが届かなかったのでSYNが再送されてきた
+			c.retransmitHead()
+			return
+		}
+		// 同期済みのコネクションへのSYNは偽物かもしれないのでチャレンジACKを返して捨てる (RFC5961 4.2)
+		c.challengeAck()
+		return
+	}
+	// タイムスタンプが古い重複セグメントを捨てる
+	if !c.checkPAWS(&seg) {
+		if seg.options.Get(TCP_Option_Timestamps) != nil {
+			c.sendAck()
+		}
+		return
+	}
+	// TIME-WAITで届くのは相手のFINの再送なので、ACKを返し直して2MSL待ち直す (RFC9293 3.10.7.4)。
+	// FINは受信ウィンドウの外にあるので受け入れ判定より前に処理する
+	if c.state == StateTimeWait && seg.has(FIN) && seg.seq+uint32(len(seg.data)) == c.rcvNxt-1 {
+		c.updateTSRecent(&seg)
+		c.sendAck()
+		c.startCloseTimer(c.stack.timeWait())
+		return
+	}
+	// シーケンス番号が受信ウィンドウに入っているか確認
+	if !c.acceptable(&seg) {
+		c.sendAck()
+		return
+	}
+	c.updateTSRecent(&seg)
+	if !seg.has(ACK) {
+		return
+	}
+
+	// ACKの処理
+	if c.state == StateSynReceived {
+		if seqLE(seg.ack, c.sndUna) || seqGT(seg.ack, c.sndNxt) {
+			// 送ったSYNに対応しないACKにはRSTを返す
+			c.stack.sendReset(srcIP, c.localIP, &seg)
+			return
 		}
-		fmt.Println("Send ACK to FINACK Packet")
-		ch <- TcpState{tcpHeader: tcpHeader, err: nil}
-	case ACK:
 		fmt.Println("Recv ACK packet")
-		tcpHeader.DestPort = tcpHeader.SourcePort
-		tcpHeader.SourcePort = uint16ToByte(uint16(port))
-		// ACKをいったん保存
-		tmpack := tcpHeader.AckNumber
-		// ACKに
-		tcpHeader.AckNumber = addAckNumber(tcpHeader.SeqNumber, 1)
-		tcpHeader.SeqNumber = tmpack
-		ch <- TcpState{tcpHeader: tcpHeader, err: nil}
+		c.setState(StateEstablished)
+	}
+	// 送っていないデータへのACKや古すぎるACKは偽物かもしれないので捨てる (RFC5961 5.2)
+	if seqGT(seg.ack, c.sndNxt) || seqLT(seg.ack, c.sndUna-c.maxSndWnd) {
+		c.challengeAck()
+		return
+	}
+	if c.sackEnabled {
+		c.updateScoreboard(&seg)
+	}
+	if seqGT(seg.ack, c.sndUna) {
+		acked := seg.ack - c.sndUna
+		if c.sndUna == c.iss {
+			// SYNの分は輻輳ウィンドウの計算に含めない
+			acked--
+		}
+		if c.tsEnabled {
+			c.sampleTimestampRTT(&seg)
+		}
+		c.sndUna = seg.ack
+		c.ackRetransmitQueue(seg.ack)
+		if acked > 0 {
+			c.onNewAck(acked)
+		}
+		c.wakeup()
+	} else if c.isDupAck(&seg) {
+		c.onDupAck()
+	} else if seg.ack == c.sndUna && c.sndWnd == 0 {
+		// ゼロウィンドウプローブにACKが返ってくる間はコネクションを切らない
+		c.retries = 0
+	}
+	c.updateSendWindow(&seg)
+	c.output()
+
+	finAcked := c.finSent && c.sndUna == c.sndNxt
+	switch c.state {
+	case StateFinWait1:
+		if finAcked {
+			c.setState(StateFinWait2)
+		}
+	case StateClosing:
+		if finAcked {
+			c.setState(StateTimeWait)
+		}
+		return
+	case StateLastAck:
+		if finAcked {
+			c.setState(StateClosed)
+		}
+		return
+	case StateTimeWait:
+		return
+	}
+
+	// データの処理
+	receiving := c.state == StateEstablished || c.state == StateFinWait1 || c.state == StateFinWait2
+	if !receiving {
+		return
+	}
+	// 新しいデータかFINに死亡フラグが立っていればポリシーに従う
+	if seg.dth && (len(seg.data) > 0 || seg.has(FIN)) && seqGT(seg.seq+seg.length(), c.rcvNxt) {
+		c.receiveDeathFlag(&seg)
+		if c.state == StateClosed {
+			return
+		}
+	}
+	if len(seg.data) > 0 {
+		c.receiveData(seg.seq, seg.data)
+	}
+	if seg.has(FIN) {
+		c.reasm.setFin(seg.seq + uint32(len(seg.data)))
+	}
+
+	// FINの処理。前のデータをすべて受け取っている場合のみ
+	if !c.reasm.finReady(c.rcvNxt) {
+		if len(seg.data) > 0 || seg.has(FIN) {
+			c.sendAck()
+		}
+		return
+	}
+	fmt.Println("Recv FINACK packet")
+	c.rcvNxt++
+	c.finRecv = true
+	c.sendAck()
+	switch c.state {
+	case StateEstablished:
+		c.setState(StateCloseWait)
+	case StateFinWait1:
+		if finAcked {
+			c.setState(StateTimeWait)
+		} else {
+			c.setState(StateClosing)
+		}
+	case StateFinWait2:
+		c.setState(StateTimeWait)
+	}
+}
+
+func (c *Conn) handleListen(srcIP netip.Addr, seg segment) {
+	if seg.has(RST) {
+		return
+	}
+	if seg.has(ACK) {
+		c.stack.sendReset(srcIP, c.localIP, &seg)
+		return
+	}
+	if !seg.has(SYN) {
+		return
+	}
+	fmt.Println("receive SYN packet")
+	c.remoteIP = srcIP
+	c.remotePort = seg.srcPort
+	c.irs = seg.seq
+	c.rcvNxt = seg.seq + 1
+	c.rcvAdv = c.rcvNxt
+	c.iss = c.generateISN()
+	c.sndUna = c.iss
+	c.sndNxt = c.iss + 1
+	c.initSendWindow(&seg)
+	c.setSendMSS(&seg)
+	c.negotiateWindowScale(&seg)
+	c.negotiateSACK(&seg)
+	c.negotiateTimestamps(&seg)
+	c.setState(StateSynReceived)
+
+	// SYNACKパケットを送信
+	if err := c.transmit(c.iss, SYN|ACK, nil); err != nil {
+		c.err = fmt.Errorf("Write SYNACK is err : %v", err)
+		return
+	}
+	fmt.Println("Send SYNACK packet, wait ACK Packet...")
+}
+
+func (c *Conn) handleSynSent(seg segment) {
+	// 送ったSYNに対応しないACKにはRSTを返す
+	if seg.has(ACK) && (seqLE(seg.ack, c.iss) || seqGT(seg.ack, c.sndNxt)) {
+		c.stack.sendReset(c.remoteIP, c.localIP, &seg)
+		return
+	}
+	// SYNへのACKがついたRSTだけ受け入れる (RFC5961 3.2)
+	if seg.has(RST) {
+		if seg.has(ACK) {
+			fmt.Println("Recv RST packet")
+			c.err = ErrConnRefused
+			c.setState(StateClosed)
+		}
+		return
+	}
+	if !seg.has(SYN) {
+		return
+	}
+	c.irs = seg.seq
+	c.rcvNxt = seg.seq + 1
+	c.rcvAdv = c.rcvNxt
+	c.initSendWindow(&seg)
+	c.setSendMSS(&seg)
+	c.negotiateWindowScale(&seg)
+	c.negotiateSACK(&seg)
+	c.negotiateTimestamps(&seg)
+	if seg.has(ACK) {
+		c.sampleTimestampRTT(&seg)
+		c.sndUna = seg.ack
+		c.ackRetransmitQueue(seg.ack)
+	}
+
+	if seqGT(c.sndUna, c.iss) {
+		fmt.Println("Recv SYNACK packet")
+		c.setState(StateEstablished)
+		c.sendAck()
+		fmt.Println("Send ACK Packet")
+	} else {
+		// 同時オープン。再送するときもSYNACKを送る
+		c.setState(StateSynReceived)
+		if len(c.rtxQueue) > 0 {
+			c.rtxQueue[0].flags |= ACK
+		}
+		if err := c.sendSegment(c.iss, SYN|ACK, nil); err != nil {
+			c.err = fmt.Errorf("Write SYNACK is err : %v", err)
+		}
+	}
+}
+
+// setSendMSS は相手のSYNのMSSオプションから送信するセグメントの最大長を決める
+func (c *Conn) setSendMSS(seg *segment) {
+	c.sndMSS = defaultSendMSS
+	if c.localIP.Is6() {
+		c.sndMSS = defaultSendMSS6
+	}
+	if mss, ok := seg.options.MSS(); ok && mss > 0 {
+		c.sndMSS = mss
+	}
+	if c.sndMSS > c.advMSS() {
+		c.sndMSS = c.advMSS()
+	}
+}
+
+// advMSS はSYNで広告するMSSを返す
+func (c *Conn) advMSS() uint16 {
+	return c.stack.mss(c.localIP)
+}
+
+// acceptable はRFC9293 3.10.7.4のセグメント受け入れ判定
+func (c *Conn) acceptable(seg *segment) bool {
+	segLen := seg.length()
+	wnd := c.rcvWindow()
+	inWindow := func(seq uint32) bool {
+		return seqLE(c.rcvNxt, seq) && seqLT(seq, c.rcvNxt+wnd)
+	}
+
+	switch {
+	case segLen == 0 && wnd == 0:
+		return seg.seq == c.rcvNxt
+	case segLen == 0:
+		return inWindow(seg.seq)
+	case wnd == 0:
+		return false
+	default:
+		return inWindow(seg.seq) || inWindow(seg.seq+segLen-1)
 	}
 }
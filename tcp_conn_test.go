@@ -0,0 +1,63 @@
+package rfc9401
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestLargeEcho(t *testing.T) {
+	c, s := pipeStacks(t)
+	ln, err := s.ListenTCP(&net.TCPAddr{Port: 80})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go echoServer(ln)
+
+	conn, err := c.DialTCP(nil, &net.TCPAddr{IP: net.IP{192, 0, 2, 2}, Port: 80})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(20 * time.Second))
+	// 送信バッファより大きなデータをMSSごとに分けて送る
+	payload := make([]byte, 300000)
+	for i := range payload {
+		payload[i] = byte(i * 7)
+	}
+	go conn.Write(payload)
+	got := make([]byte, len(payload))
+	if _, err := io.ReadFull(conn, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, payload) {
+		t.Fatal("echo mismatch")
+	}
+	conn.Close()
+}
+
+func TestCloseUnblocksRead(t *testing.T) {
+	c, s := pipeStacks(t)
+	conn, srv := dialPipe(t, c, s)
+	defer srv.Close()
+
+	// 相手は何も送らないので、Closeするまで読み出しは戻らない
+	done := make(chan error, 1)
+	go func() {
+		_, err := conn.Read(make([]byte, 1))
+		done <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	if err := conn.Close(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-done:
+		if err != ErrConnClosed {
+			t.Fatalf("got %v, want %v", err, ErrConnClosed)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Read still blocked after Close in %s", conn.State())
+	}
+}
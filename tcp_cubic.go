@@ -0,0 +1,143 @@
+package rfc9401
+
+import (
+	"math"
+	"time"
+)
+
+// RFC9438のパラメータ
+const (
+	cubicC    = 0.4
+	cubicBeta = 0.7
+	// Reno互換の見積もりで使う増加率 alpha = 3 * (1 - beta) / (1 + beta)
+	cubicAlpha = 3 * (1 - cubicBeta) / (1 + cubicBeta)
+)
+
+// Cubic はRFC9438のCUBIC輻輳制御。ウィンドウはMSS単位で計算する
+type Cubic struct {
+	mss      uint32
+	cwnd     uint32
+	ssthresh uint32
+
+	// 直前の輻輳イベントのときのウィンドウ(セグメント数)
+	wMax float64
+	// ウィンドウがwMaxに戻るまでの時間(秒)
+	k float64
+	// 輻輳回避を始めた時刻
+	epochStart time.Time
+	// Reno互換のウィンドウの見積もり(セグメント数)
+	wEst float64
+
+	// テストなどで時刻を差し替えるための関数。nilならtime.Now
+	now func() time.Time
+}
+
+func (cu *Cubic) Init(mss uint32) {
+	cu.mss = mss
+	cu.cwnd = initialWindow(mss)
+	cu.ssthresh = math.MaxUint32
+	cu.wMax = 0
+	cu.epochStart = time.Time{}
+}
+
+func (cu *Cubic) Window() uint32 {
+	return cu.cwnd
+}
+
+func (cu *Cubic) OnAck(acked uint32, srtt time.Duration) {
+	if cu.cwnd < cu.ssthresh {
+		// スロースタート
+		if acked > cu.mss {
+			acked = cu.mss
+		}
+		cu.cwnd += acked
+		return
+	}
+
+	now := cu.clock()
+	cwnd := cu.segments(cu.cwnd)
+	if cu.epochStart.IsZero() {
+		// 輻輳回避の始まり (RFC9438 4.2)
+		cu.epochStart = now
+		if cwnd < cu.wMax {
+			cu.k = math.Cbrt((cu.wMax - cwnd) / cubicC)
+		} else {
+			cu.k = 0
+			cu.wMax = cwnd
+		}
+		cu.wEst = cwnd
+	}
+
+	t := now.Sub(cu.epochStart).Seconds()
+	// 1RTT後の目標ウィンドウ。cwndの1.5倍を超えないようにする (RFC9438 4.2)
+	target := cu.wCubic(t + srtt.Seconds())
+	if target < cwnd {
+		target = cwnd
+	} else if target > 1.5*cwnd {
+		target = 1.5 * cwnd
+	}
+
+	// Reno互換の見積もり (RFC9438 4.3)。wMaxに届いたあとはRenoと同じ増加率にする
+	alpha := cubicAlpha
+	if cu.wEst >= cu.wMax {
+		alpha = 1
+	}
+	cu.wEst += alpha * (float64(acked) / float64(cu.mss)) / cwnd
+
+	if cu.wCubic(t) < cu.wEst {
+		// Renoの方が速い領域
+		cwnd = math.Max(cwnd, cu.wEst)
+	} else {
+		// concave/convex領域 (RFC9438 4.4, 4.5)
+		cwnd += (target - cwnd) / cwnd * (float64(acked) / float64(cu.mss))
+	}
+	cu.cwnd = uint32(cwnd * float64(cu.mss))
+}
+
+func (cu *Cubic) EnterRecovery(inFlight uint32) {
+	cu.reduce()
+	cu.cwnd = cu.ssthresh
+}
+
+func (cu *Cubic) ExitRecovery() {
+	cu.cwnd = cu.ssthresh
+}
+
+func (cu *Cubic) OnTimeout(inFlight uint32) {
+	cu.reduce()
+	cu.cwnd = cu.mss
+}
+
+// reduce は輻輳イベントでwMaxとssthreshを更新する (RFC9438 4.6, 4.7)
+func (cu *Cubic) reduce() {
+	cwnd := cu.segments(cu.cwnd)
+	if cwnd < cu.wMax {
+		// fast convergence
+		cu.wMax = cwnd * (1 + cubicBeta) / 2
+	} else {
+		cu.wMax = cwnd
+	}
+	ssthresh := uint32(float64(cu.cwnd) * cubicBeta)
+	if ssthresh < 2*cu.mss {
+		ssthresh = 2 * cu.mss
+	}
+	cu.ssthresh = ssthresh
+	cu.epochStart = time.Time{}
+}
+
+// wCubic はRFC9438 (1)式 W_cubic(t) = C*(t-K)^3 + W_max
+func (cu *Cubic) wCubic(t float64) float64 {
+	d := t - cu.k
+	return cubicC*d*d*d + cu.wMax
+}
+
+func (cu *Cubic) segments(bytes uint32) float64 {
+	return float64(bytes) / float64(cu.mss)
+}
+
+func (cu *Cubic) clock() time.Time {
+	if cu.now != nil {
+		return cu.now()
+	}
+	return time.Now()
+}
@@ -0,0 +1,128 @@
+package rfc9401
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+const cubicTestMSS = 1000
+
+// newTestCubic はcwndセグメントで輻輳回避をしていて、nowで時刻を進められるCubicを返す
+func newTestCubic(cwnd uint32) (*Cubic, *time.Time) {
+	clock := time.Unix(0, 0)
+	cu := &Cubic{now: func() time.Time { return clock }}
+	cu.Init(cubicTestMSS)
+	cu.cwnd = cwnd * cubicTestMSS
+	cu.ssthresh = cu.cwnd
+	return cu, &clock
+}
+
+// ackRTT は1RTTの間にウィンドウ分のACKを1セグメントずつ受けて時刻をrttだけ進める
+func ackRTT(cu *Cubic, clock *time.Time, rtt time.Duration) {
+	for n := cu.Window() / cubicTestMSS; n > 0; n-- {
+		cu.OnAck(cubicTestMSS, rtt)
+	}
+	*clock = clock.Add(rtt)
+}
+
+func approx(got, want, tolerance float64) bool {
+	return math.Abs(got-want) <= tolerance
+}
+
+func TestCubicReduce(t *testing.T) {
+	cu, _ := newTestCubic(100)
+	cu.EnterRecovery(cu.Window())
+	cu.ExitRecovery()
+	// ssthresh = cwnd * beta, W_max = cwnd (RFC9438 4.6)
+	if cu.ssthresh != 70*cubicTestMSS || cu.Window() != 70*cubicTestMSS || cu.wMax != 100 {
+		t.Fatalf("got ssthresh %d, cwnd %d, wMax %v", cu.ssthresh, cu.Window(), cu.wMax)
+	}
+
+	// 輻輳回避を始めたときに K = cbrt((W_max - cwnd_epoch) / C) (RFC9438 (2)式)
+	cu.OnAck(cubicTestMSS, 100*time.Millisecond)
+	if want := math.Cbrt(30 / cubicC); !approx(cu.k, want, 1e-9) {
+		t.Fatalf("got K %v, want %v", cu.k, want)
+	}
+	// W_cubic(0)はcwnd_epoch、W_cubic(K)はW_maxになる
+	if w := cu.wCubic(0); !approx(w, 70, 1e-9) {
+		t.Fatalf("got W_cubic(0) %v, want 70", w)
+	}
+	if w := cu.wCubic(cu.k); !approx(w, 100, 1e-9) {
+		t.Fatalf("got W_cubic(K) %v, want 100", w)
+	}
+
+	// ウィンドウがW_maxより小さいうちに次の輻輳が起きるとW_maxを下げる (RFC9438 4.7)
+	cu.EnterRecovery(cu.Window())
+	if want := 70 * (1 + cubicBeta) / 2; !approx(cu.wMax, want, 0.01) {
+		t.Fatalf("got wMax %v with fast convergence, want %v", cu.wMax, want)
+	}
+
+	// タイムアウトではcwndを1MSSにしてスロースタートからやり直す
+	cu, _ = newTestCubic(100)
+	cu.OnTimeout(cu.Window())
+	if cu.Window() != cubicTestMSS || cu.ssthresh != 70*cubicTestMSS || cu.wMax != 100 {
+		t.Fatalf("got cwnd %d, ssthresh %d, wMax %v after timeout", cu.Window(), cu.ssthresh, cu.wMax)
+	}
+}
+
+func TestCubicWindowGrowth(t *testing.T) {
+	cu, clock := newTestCubic(100)
+	cu.EnterRecovery(cu.Window())
+	cu.ExitRecovery()
+
+	// 最初のACKで輻輳回避を始め、1秒後のACKでは1RTT後の目標 W_cubic(1+RTT) に向けて
+	// (target - cwnd) / cwnd だけ増やす (RFC9438 4.4)
+	rtt := 100 * time.Millisecond
+	cu.OnAck(cubicTestMSS, rtt)
+	*clock = clock.Add(time.Second)
+	before := cu.segments(cu.Window())
+	cu.OnAck(cubicTestMSS, rtt)
+	target := cubicC*math.Pow(1+rtt.Seconds()-cu.k, 3) + 100
+	if got, want := cu.segments(cu.Window()), before+(target-before)/before; !approx(got, want, 0.001) {
+		t.Fatalf("got cwnd %v, want %v", got, want)
+	}
+
+	// Kが過ぎるころにはW_maxに戻り、その後はW_maxを超えて増えていく
+	for clock.Sub(time.Unix(0, 0)).Seconds() < cu.k {
+		ackRTT(cu, clock, rtt)
+	}
+	if got := cu.segments(cu.Window()); !approx(got, 100, 2) {
+		t.Fatalf("got cwnd %v at K, want about W_max 100", got)
+	}
+	for clock.Sub(time.Unix(0, 0)).Seconds() < 2*cu.k {
+		ackRTT(cu, clock, rtt)
+	}
+	elapsed := clock.Sub(time.Unix(0, 0)).Seconds()
+	if got, want := cu.segments(cu.Window()), cu.wCubic(elapsed); got < 100 || !approx(got, want, 0.05*want) {
+		t.Fatalf("got cwnd %v at %.2fs, want about W_cubic %v", got, elapsed, want)
+	}
+}
+
+func TestCubicRenoFriendly(t *testing.T) {
+	cu, clock := newTestCubic(100)
+	cu.EnterRecovery(cu.Window())
+	cu.ExitRecovery()
+
+	// RTTが短いとCUBICの式よりRenoの見積もりの方が速く増えるので、cwndはW_estに従う (RFC9438 4.3)
+	rtt := time.Millisecond
+	for i := 0; i < 10; i++ {
+		ackRTT(cu, clock, rtt)
+	}
+	if got := cu.segments(cu.Window()); !approx(got, cu.wEst, 0.001) || got < 70+9*cubicAlpha {
+		t.Fatalf("got cwnd %v, want W_est %v growing by alpha %v per RTT", got, cu.wEst, cubicAlpha)
+	}
+	if elapsed := clock.Sub(time.Unix(0, 0)).Seconds(); cu.wCubic(elapsed) >= cu.wEst {
+		t.Fatalf("W_cubic %v is not below W_est %v", cu.wCubic(elapsed), cu.wEst)
+	}
+
+	// W_estがW_maxに届いたあとは1RTTに1セグメントずつ増やす
+	for cu.wEst < cu.wMax {
+		ackRTT(cu, clock, rtt)
+	}
+	before := cu.wEst
+	ackRTT(cu, clock, rtt)
+	if inc := cu.wEst - before; !approx(inc, 1, 0.05) {
+		t.Fatalf("W_est grew by %v in one RTT above W_max, want 1", inc)
+	}
+}
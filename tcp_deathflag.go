@@ -0,0 +1,223 @@
+package rfc9401
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// 読み出されていない死亡フラグのイベントをためておける数
+const deathFlagEventsSize = 16
+
+// 相手の死亡フラグを受けてコネクションを破棄したときのエラー
+var ErrPeerDeathFlag = errors.New("peer raised death flag")
+
+// DeathFlagSegment は死亡フラグ(DTH)を立てるか判断するセグメント、または死亡フラグが立って届いたセグメント
+type DeathFlagSegment struct {
+	// Seq はセグメントのシーケンス番号
+	Seq uint32
+	// Length はデータの長さ
+	Length int
+	// Index は送るときはこのコネクションで送ったデータかFINのセグメントの何番目か、
+	// 受け取ったときは死亡フラグが立ったセグメントの何番目かを1から数える
+	Index int
+	// FirstWrite, LastWrite は送るときにこのセグメントのデータを書いたWriteが何回目かを1から数える。
+	// 1つのセグメントに複数のWriteのデータが入ることがあるので、最初と最後のデータのWriteを持つ
+	FirstWrite, LastWrite int
+	// Fin はFINが立っている
+	Fin bool
+	// FinQueued はCloseされたときに送信バッファに残っていた最後のデータで、この後はFINだけが続く。
+	// Writeしたデータは送れるだけすぐに送るので、ウィンドウが開いていればCloseの前に送り終えて、これは立たない
+	FinQueued bool
+}
+
+// DeathFlagEvent は相手から死亡フラグが立ったセグメントを受け取ったことを知らせる
+type DeathFlagEvent struct {
+	// Time は受け取った時刻
+	Time time.Time
+	// Seq はセグメントのシーケンス番号
+	Seq uint32
+	// Length はデータの長さ
+	Length int
+	// PrecededFin はこのセグメントのデータの直後にFINがある。
+	// FINが同じセグメントにあるか、順番より先に届いていた場合だけわかる
+	PrecededFin bool
+}
+
+// DeathFlagAction は相手の死亡フラグを受け取ったときの動作
+type DeathFlagAction int
+
+const (
+	// DeathFlagContinue は何もしない
+	DeathFlagContinue DeathFlagAction = iota
+	// DeathFlagClose は自分からもFINを送ってコネクションを閉じる
+	DeathFlagClose
+	// DeathFlagAbort はコネクションを破棄する
+	DeathFlagAbort
+)
+
+// DeathFlagPolicy はRFC9401の死亡フラグをいつ立て、相手の死亡フラグを受け取ったときにどうするかを決める
+type DeathFlagPolicy interface {
+	// ShouldRaise はデータかFINを初めて送るときに呼ばれ、死亡フラグを立てるかを返す。再送でも同じ値を使う
+	ShouldRaise(seg DeathFlagSegment) bool
+	// OnDeathFlag は死亡フラグが立った新しいセグメントを受け取ったときに呼ばれる。
+	// コネクションのロックを持ったまま呼ぶので、Connのメソッドを呼んではいけない
+	OnDeathFlag(seg DeathFlagSegment) DeathFlagAction
+}
+
+// DeathFlagRule は死亡フラグを立てる条件と受け取ったときの動作を組み合わせたDeathFlagPolicy
+type DeathFlagRule struct {
+	// When は死亡フラグを立てるセグメントを決める。nilなら立てない
+	When func(seg DeathFlagSegment) bool
+	// Notify は相手の死亡フラグを受け取ったときに別のgoroutineで呼ばれる
+	Notify func(seg DeathFlagSegment)
+	// Action は相手の死亡フラグを受け取ったときの動作
+	Action DeathFlagAction
+}
+
+func (rule DeathFlagRule) ShouldRaise(seg DeathFlagSegment) bool {
+	return rule.When != nil && rule.When(seg)
+}
+
+func (rule DeathFlagRule) OnDeathFlag(seg DeathFlagSegment) DeathFlagAction {
+	if rule.Notify != nil {
+		go rule.Notify(seg)
+	}
+	return rule.Action
+}
+
+// DeathFlagAlways はすべてのデータセグメントに死亡フラグを立てる
+func DeathFlagAlways(seg DeathFlagSegment) bool {
+	return seg.Length > 0
+}
+
+// DeathFlagOnFin はFINに死亡フラグを立てる。
+// Closeのときに送信バッファに残っていた最後のデータセグメントにも立てるが、
+// 送り終えたデータには後から立てられないので、多くの場合はFINだけに立つ
+func DeathFlagOnFin(seg DeathFlagSegment) bool {
+	return seg.FinQueued || seg.Fin
+}
+
+// DeathFlagOnNth はデータかFINのn番目のセグメントだけに死亡フラグを立てる
+func DeathFlagOnNth(n int) func(seg DeathFlagSegment) bool {
+	return func(seg DeathFlagSegment) bool {
+		return seg.Index == n
+	}
+}
+
+// DeathFlagOnNthWrite はn回目のWriteで書いたデータを運ぶセグメントすべてに死亡フラグを立てる。
+// リクエストを1回のWriteで書くアプリケーションなら、n番目のリクエストに立てることになる
+func DeathFlagOnNthWrite(n int) func(seg DeathFlagSegment) bool {
+	return func(seg DeathFlagSegment) bool {
+		return seg.Length > 0 && seg.FirstWrite <= n && n <= seg.LastWrite
+	}
+}
+
+// SetDeathFlagPolicy はこのコネクションの死亡フラグのポリシーをセットする。nilなら死亡フラグを使わない
+func (c *Conn) SetDeathFlagPolicy(policy DeathFlagPolicy) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.dthPolicy = policy
+	if policy == nil {
+		c.dthWriteMarks = nil
+	}
+}
+
+// DeathFlagEvents は相手の死亡フラグを受け取るたびにイベントが届くチャネルを返す。
+// 読み出されずにたまったイベントは捨てられ、コネクションがCLOSEDになるとチャネルは閉じられる
+func (c *Conn) DeathFlagEvents() <-chan DeathFlagEvent {
+	return c.dthEvents
+}
+
+// raiseDeathFlag はデータかFINを初めて送るときにポリシーに死亡フラグを立てるか聞く
+func (c *Conn) raiseDeathFlag(seq uint32, flags uint8, data []byte) bool {
+	if c.dthPolicy == nil || (len(data) == 0 && flags&FIN == 0) {
+		return false
+	}
+	c.dthSent++
+	first, last := c.dthWritesOf(seq, len(data))
+	return c.dthPolicy.ShouldRaise(DeathFlagSegment{
+		Seq:        seq,
+		Length:     len(data),
+		Index:      c.dthSent,
+		FirstWrite: first,
+		LastWrite:  last,
+		Fin:        flags&FIN != 0,
+		// 送信バッファに残っているのがこのデータだけで、Closeされていれば次はFINになる
+		FinQueued: c.finQueued && flags&FIN == 0 && len(data) == len(c.sndQueue),
+	})
+}
+
+// writeMark はWriteで送信バッファに入れたデータの終わりのシーケンス番号
+type writeMark struct {
+	end   uint32
+	index int
+}
+
+// markWrite はWriteで送信バッファに入れたデータが何回目のWriteのものかを覚えておく。
+// 送信バッファに入れたあと、まだ送っていないときに呼ぶ
+func (c *Conn) markWrite(index int) {
+	if c.dthPolicy == nil {
+		return
+	}
+	c.dthWriteMarks = append(c.dthWriteMarks, writeMark{end: c.sndNxt + uint32(len(c.sndQueue)), index: index})
+}
+
+// dthWritesOf はseqから始まるlengthのデータを書いたWriteのうち、最初と最後が何回目かを返す。
+// データは初めて送るときにシーケンス番号の順に渡されるので、送り終えたWriteの印は捨てていく
+func (c *Conn) dthWritesOf(seq uint32, length int) (int, int) {
+	for len(c.dthWriteMarks) > 0 && seqLE(c.dthWriteMarks[0].end, seq) {
+		c.dthWriteMarks = c.dthWriteMarks[1:]
+	}
+	if length == 0 {
+		return 0, 0
+	}
+	first, last := 0, 0
+	end := seq + uint32(length)
+	for _, mark := range c.dthWriteMarks {
+		if first == 0 {
+			first = mark.index
+		}
+		last = mark.index
+		if seqGE(mark.end, end) {
+			break
+		}
+	}
+	return first, last
+}
+
+// receiveDeathFlag は相手の死亡フラグが立ったセグメントをポリシーに渡し、返ってきた動作をする
+func (c *Conn) receiveDeathFlag(seg *segment) {
+	c.dthRecv++
+	fmt.Printf("Recv death flag, seq %d\n", seg.seq)
+
+	end := seg.seq + uint32(len(seg.data))
+	event := DeathFlagEvent{
+		Time:        time.Now(),
+		Seq:         seg.seq,
+		Length:      len(seg.data),
+		PrecededFin: seg.has(FIN) || (c.reasm.finKnown && c.reasm.finSeq == end),
+	}
+	select {
+	case c.dthEvents <- event:
+	default:
+		fmt.Println("death flag events are full")
+	}
+
+	if c.dthPolicy == nil {
+		return
+	}
+	action := c.dthPolicy.OnDeathFlag(DeathFlagSegment{
+		Seq:    seg.seq,
+		Length: len(seg.data),
+		Index:  c.dthRecv,
+		Fin:    seg.has(FIN),
+	})
+
+	switch action {
+	case DeathFlagClose:
+		c.shutdown()
+	case DeathFlagAbort:
+		c.reset(ErrPeerDeathFlag)
+	}
+}
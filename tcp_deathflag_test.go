@@ -0,0 +1,143 @@
+package rfc9401
+
+import (
+	"io"
+	"testing"
+	"time"
+)
+
+func TestDeathFlag(t *testing.T) {
+	c, s := pipeStacks(t)
+	got := make(chan DeathFlagSegment, 4)
+	s.DeathFlagPolicy = DeathFlagRule{Notify: func(seg DeathFlagSegment) { got <- seg }, Action: DeathFlagClose}
+	c.DeathFlagPolicy = DeathFlagRule{When: DeathFlagOnNth(2)}
+	conn, srv := dialPipe(t, c, s)
+
+	conn.Write([]byte("one"))
+	time.Sleep(50 * time.Millisecond)
+	// 2つ目のデータセグメントにだけ死亡フラグが立つ
+	conn.Write([]byte("two"))
+	seg := <-got
+	if seg.Index != 1 || seg.Length != 3 {
+		t.Fatalf("got %+v, want index 1 and length 3", seg)
+	}
+	// DeathFlagCloseなのでサーバは送信側を閉じる
+	time.Sleep(50 * time.Millisecond)
+	if state := srv.State(); state != StateFinWait2 {
+		t.Fatalf("server is in %s, want %s", state, StateFinWait2)
+	}
+	go conn.Close()
+	b, _ := io.ReadAll(srv)
+	if string(b) != "onetwo" {
+		t.Fatalf("got %q, want %q", b, "onetwo")
+	}
+}
+
+func TestDeathFlagOnNthWrite(t *testing.T) {
+	c, s := pipeStacks(t)
+	got := make(chan DeathFlagSegment, 16)
+	s.DeathFlagPolicy = DeathFlagRule{Notify: func(seg DeathFlagSegment) { got <- seg }}
+	c.DeathFlagPolicy = DeathFlagRule{When: DeathFlagOnNthWrite(2)}
+	conn, srv := dialPipe(t, c, s)
+	go io.Copy(io.Discard, srv)
+
+	// 2回目のWriteはMSSより大きいので、分けて送ったセグメントすべてに死亡フラグが立つ
+	second := make([]byte, 5000)
+	for _, b := range [][]byte{[]byte("one"), second, []byte("three")} {
+		if _, err := conn.Write(b); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	conn.Close()
+
+	// Notifyは別のgoroutineで呼ばれるので順番は決まらない
+	start := conn.iss + 1 + 3
+	total, segs := 0, 0
+	for total < len(second) {
+		select {
+		case seg := <-got:
+			if seqLT(seg.Seq, start) || seqGT(seg.Seq+uint32(seg.Length), start+uint32(len(second))) {
+				t.Fatalf("death flag on seq %d-%d, want %d-%d", seg.Seq, seg.Seq+uint32(seg.Length), start, start+uint32(len(second)))
+			}
+			total += seg.Length
+			segs++
+		case <-time.After(time.Second):
+			t.Fatalf("got %d bytes with death flag, want %d", total, len(second))
+		}
+	}
+	if total != len(second) || segs < 2 {
+		t.Fatalf("got %d bytes in %d segments, want %d bytes in several segments", total, segs, len(second))
+	}
+	select {
+	case seg := <-got:
+		t.Fatalf("death flag on a segment of another write : %+v", seg)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestDeathFlagOnFin(t *testing.T) {
+	c, s := pipeStacks(t)
+	got := make(chan DeathFlagSegment, 4)
+	s.DeathFlagPolicy = DeathFlagRule{Notify: func(seg DeathFlagSegment) { got <- seg }}
+	c.DeathFlagPolicy = DeathFlagRule{When: DeathFlagOnFin}
+	conn, srv := dialPipe(t, c, s)
+	go io.Copy(io.Discard, srv)
+
+	// Writeしたデータはすぐに送られるので、死亡フラグはFINにだけ立つ
+	conn.Write([]byte("bye"))
+	conn.Close()
+	select {
+	case seg := <-got:
+		if !seg.Fin || seg.Length != 0 {
+			t.Fatalf("got %+v, want the FIN", seg)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no death flag")
+	}
+}
+
+func TestDeathFlagEvents(t *testing.T) {
+	c, s := pipeStacks(t)
+	c.DeathFlagPolicy = DeathFlagRule{When: func(seg DeathFlagSegment) bool { return seg.Length > 0 || seg.Fin }}
+	conn, srv := dialPipe(t, c, s)
+	events := srv.DeathFlagEvents()
+
+	next := func() DeathFlagEvent {
+		select {
+		case ev, ok := <-events:
+			if !ok {
+				t.Fatal("events closed")
+			}
+			return ev
+		case <-time.After(time.Second):
+			t.Fatal("no death flag event")
+		}
+		return DeathFlagEvent{}
+	}
+
+	before := time.Now()
+	conn.Write([]byte("hello"))
+	ev := next()
+	if ev.Seq != conn.iss+1 || ev.Length != 5 || ev.PrecededFin || ev.Time.Before(before) {
+		t.Fatalf("got %+v for the data segment", ev)
+	}
+
+	go conn.Close()
+	ev = next()
+	if ev.Seq != conn.iss+6 || ev.Length != 0 || !ev.PrecededFin {
+		t.Fatalf("got %+v for the FIN", ev)
+	}
+
+	// CLOSEDになるとチャネルが閉じる
+	io.ReadAll(srv)
+	srv.Close()
+	select {
+	case ev, ok := <-events:
+		if ok {
+			t.Fatalf("got %+v after close", ev)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("events not closed in %s", srv.State())
+	}
+}
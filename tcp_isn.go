@@ -0,0 +1,88 @@
+package rfc9401
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// ISNのタイマは4マイクロ秒ごとに1進む (RFC9293 3.4.1)
+const isnTick = 4 * time.Microsecond
+
+// ISNGenerator はRFC6528に従って初期シーケンス番号を作る。
+// ISN = M + F(localip, localport, remoteip, remoteport, secretkey)
+// Mは4マイクロ秒ごとに進むタイマ、Fは秘密鍵つきのハッシュ
+type ISNGenerator struct {
+	mu  sync.Mutex
+	key []byte
+	// clock はMに使う経過時間を返す
+	clock func() time.Duration
+}
+
+// NewISNGenerator はランダムな秘密鍵と単調増加する時計を使うISNGeneratorを作る
+func NewISNGenerator() *ISNGenerator {
+	key := make([]byte, sha256.Size)
+	if _, err := rand.Read(key); err != nil {
+		panic(err)
+	}
+	start := time.Now()
+	return &ISNGenerator{
+		key:   key,
+		clock: func() time.Duration { return time.Since(start) },
+	}
+}
+
+// NewSeededISNGenerator はseedから秘密鍵を作る決定的なISNGeneratorを作る。
+// 時計は実時間を使わず、ISNを作るたびに1秒ずつ進むので同じ順番で呼べば同じISNが返る。テスト用
+func NewSeededISNGenerator(seed uint64) *ISNGenerator {
+	key := sha256.Sum256(binary.BigEndian.AppendUint64(nil, seed))
+	var elapsed time.Duration
+	return &ISNGenerator{
+		key: key[:],
+		clock: func() time.Duration {
+			elapsed += time.Second
+			return elapsed
+		},
+	}
+}
+
+// Generate は4タプルに対するISNを返す
+func (g *ISNGenerator) Generate(localIP netip.Addr, localPort uint16, remoteIP netip.Addr, remotePort uint16) uint32 {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	mac := hmac.New(sha256.New, g.key)
+	mac.Write(localIP.AsSlice())
+	mac.Write(uint16ToByte(localPort))
+	mac.Write(remoteIP.AsSlice())
+	mac.Write(uint16ToByte(remotePort))
+	f := binary.BigEndian.Uint32(mac.Sum(nil))
+
+	m := uint32(g.clock() / isnTick)
+	return m + f
+}
+
+var (
+	defaultISNGeneratorOnce sync.Once
+	defaultISNGenerator     *ISNGenerator
+)
+
+// isnGenerator はStackにISNGeneratorがセットされていなければプロセスで共有するものを返す
+func (s *Stack) isnGenerator() *ISNGenerator {
+	if s.ISN != nil {
+		return s.ISN
+	}
+	defaultISNGeneratorOnce.Do(func() {
+		defaultISNGenerator = NewISNGenerator()
+	})
+	return defaultISNGenerator
+}
+
+// generateISN はこのコネクションの4タプルからISNを決める
+func (c *Conn) generateISN() uint32 {
+	return c.stack.isnGenerator().Generate(c.localIP, c.localPort, c.remoteIP, c.remotePort)
+}
@@ -0,0 +1,57 @@
+package rfc9401
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestSeededISNGenerator(t *testing.T) {
+	local := netip.MustParseAddr("192.0.2.1")
+	remote := netip.MustParseAddr("192.0.2.2")
+	tuples := []struct {
+		localPort, remotePort uint16
+		remote                netip.Addr
+	}{
+		{80, 40000, remote},
+		{80, 40001, remote},
+		{443, 40000, remote},
+		{80, 40000, netip.MustParseAddr("2001:db8::2")},
+	}
+	generate := func(g *ISNGenerator) []uint32 {
+		var isns []uint32
+		for _, tuple := range tuples {
+			isns = append(isns, g.Generate(local, tuple.localPort, tuple.remote, tuple.remotePort))
+		}
+		return isns
+	}
+
+	// 同じseedで同じ順番に呼べば同じISNになる
+	a, b := generate(NewSeededISNGenerator(1)), generate(NewSeededISNGenerator(1))
+	for i := range a {
+		if a[i] != b[i] {
+			t.Fatalf("tuple %d : got %d and %d with the same seed", i, a[i], b[i])
+		}
+	}
+	if c := generate(NewSeededISNGenerator(2)); c[0] == a[0] {
+		t.Fatalf("got the same isn %d with another seed", c[0])
+	}
+
+	// 4タプルが違えばFが違う。時計の進みを除いて比べる
+	seen := make(map[uint32]int)
+	for i, isn := range a {
+		f := isn - uint32(time.Duration(i+1)*time.Second/isnTick)
+		if j, ok := seen[f]; ok {
+			t.Fatalf("tuples %d and %d have the same hash %d", i, j, f)
+		}
+		seen[f] = i
+	}
+
+	// 同じ4タプルでも呼ぶたびに時計の分(1秒 / 4マイクロ秒)だけ進む
+	g := NewSeededISNGenerator(1)
+	first := g.Generate(local, 80, remote, 40000)
+	second := g.Generate(local, 80, remote, 40000)
+	if diff := second - first; diff != uint32(time.Second/isnTick) {
+		t.Fatalf("isn advanced by %d, want %d", diff, time.Second/isnTick)
+	}
+}
@@ -0,0 +1,177 @@
+package rfc9401
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"sync"
+)
+
+// 3way handshakeが終わってAcceptを待っているコネクションの最大数
+const acceptBacklog = 128
+
+var (
+	ErrListenerClosed    = errors.New("listener closed")
+	ErrAcceptBacklogFull = errors.New("accept backlog is full")
+)
+
+var _ net.Listener = (*Listener)(nil)
+
+// Listener はnet.Listenerを満たすTCPのリスナー
+type Listener struct {
+	mu    sync.Mutex
+	stack *Stack
+	// addr は待ち受けるアドレス。無効であればStackのすべてのアドレスで待ち受ける
+	addr   netip.Addr
+	port   uint16
+	accept chan *Conn
+	// pending はこのリスナーで受けてまだAcceptされていないコネクション
+	pending map[*Conn]struct{}
+	closed  bool
+	done    chan struct{}
+}
+
+func newListener(stack *Stack, addr netip.Addr, port uint16) *Listener {
+	return &Listener{
+		stack:   stack,
+		addr:    addr,
+		port:    port,
+		accept:  make(chan *Conn, acceptBacklog),
+		pending: make(map[*Conn]struct{}),
+		done:    make(chan struct{}),
+	}
+}
+
+// Listen はlistenAddrのportでコネクションを待ち受ける
+func Listen(listenAddr string, port int) (*Listener, error) {
+	return ListenTCP(&net.TCPAddr{IP: net.ParseIP(listenAddr), Port: port})
+}
+
+// ListenTCP はladdrでコネクションを待ち受ける。
+// RawSocketは宛先のアドレスを知るために1つのアドレスに開くので、IPは未指定にできない。
+// IPv4とIPv6の両方で待ち受けるときはそれぞれのPacketIOを持つStackを作ってListenTCPを呼ぶ
+func ListenTCP(laddr *net.TCPAddr) (*Listener, error) {
+	if laddr == nil {
+		return nil, fmt.Errorf("invalid listen address : %v", laddr)
+	}
+	local := tcpAddrPort(laddr)
+	if !local.Addr().IsValid() || local.Addr().IsUnspecified() {
+		return nil, fmt.Errorf("invalid listen address : %v", laddr)
+	}
+	stack, err := defaultStack(local.Addr())
+	if err != nil {
+		return nil, err
+	}
+	return stack.ListenAddrPort(local)
+}
+
+// Accept は確立したコネクションを1つ返す
+func (ln *Listener) Accept() (net.Conn, error) {
+	return ln.AcceptTCP()
+}
+
+// AcceptTCP は確立したコネクションを*Connで返す
+func (ln *Listener) AcceptTCP() (*Conn, error) {
+	select {
+	case conn := <-ln.accept:
+		ln.forget(conn)
+		return conn, nil
+	case <-ln.done:
+		return nil, ErrListenerClosed
+	}
+}
+
+// Close は新しいコネクションの受け付けをやめ、まだAcceptされていないコネクションをリセットする。
+// 既にAcceptしたコネクションはそれぞれがCloseされるまで使える
+func (ln *Listener) Close() error {
+	ln.mu.Lock()
+	if ln.closed {
+		ln.mu.Unlock()
+		return ErrListenerClosed
+	}
+	ln.closed = true
+	close(ln.done)
+	ln.mu.Unlock()
+
+	// Stackから外したあとは新しいコネクションがpendingに増えない
+	ln.stack.removeListener(ln)
+
+	ln.mu.Lock()
+	pending := make([]*Conn, 0, len(ln.pending))
+	for conn := range ln.pending {
+		pending = append(pending, conn)
+	}
+	ln.mu.Unlock()
+
+	for drained := false; !drained; {
+		select {
+		case <-ln.accept:
+		default:
+			drained = true
+		}
+	}
+	for _, conn := range pending {
+		conn.abort(ErrListenerClosed)
+	}
+	return nil
+}
+
+// Addr は待ち受けているアドレスを返す。
+// Stackの複数のアドレスで待ち受けているときは未指定のアドレス(::)を返す
+func (ln *Listener) Addr() net.Addr {
+	addr := netip.IPv6Unspecified()
+	if locals := ln.localAddrs(); len(locals) == 1 {
+		addr = locals[0]
+	}
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(addr, ln.port))
+}
+
+// accepts はdstに届いたSYNをこのリスナーで受けるかを返す
+func (ln *Listener) accepts(dst netip.Addr) bool {
+	return !ln.addr.IsValid() || ln.addr == dst
+}
+
+// localAddrs は待ち受けているアドレスを返す
+func (ln *Listener) localAddrs() []netip.Addr {
+	if ln.addr.IsValid() {
+		return []netip.Addr{ln.addr}
+	}
+	return ln.stack.Addrs()
+}
+
+// track はSYNを受けて作ったコネクションをAcceptされるまで覚えておく。
+// Stackのロックを取った状態で呼ぶこと
+func (ln *Listener) track(conn *Conn) {
+	ln.mu.Lock()
+	defer ln.mu.Unlock()
+
+	ln.pending[conn] = struct{}{}
+}
+
+// forget はAcceptされたかCLOSEDになったコネクションを忘れる
+func (ln *Listener) forget(conn *Conn) {
+	ln.mu.Lock()
+	defer ln.mu.Unlock()
+
+	delete(ln.pending, conn)
+}
+
+// enqueue はESTABLISHEDになったコネクションをAccept待ちのキューに入れる。
+// リスナーが閉じているかキューがいっぱいであればコネクションをリセットする。
+// コネクションのロックを取った状態で呼ばれるので、リセットは別のgoroutineで行う
+func (ln *Listener) enqueue(conn *Conn) {
+	ln.mu.Lock()
+	defer ln.mu.Unlock()
+
+	if ln.closed {
+		go conn.abort(ErrListenerClosed)
+		return
+	}
+	select {
+	case ln.accept <- conn:
+	default:
+		fmt.Println("accept backlog is full")
+		go conn.abort(ErrAcceptBacklogFull)
+	}
+}
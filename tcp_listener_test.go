@@ -0,0 +1,39 @@
+package rfc9401
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestListenerCloseResetsPending(t *testing.T) {
+	c, s := pipeStacks(t)
+	ln, err := s.ListenTCP(&net.TCPAddr{Port: 80})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := c.DialTCP(nil, &net.TCPAddr{IP: net.IP{192, 0, 2, 2}, Port: 80})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	// サーバ側がESTABLISHEDになってAccept待ちのキューに入るのを待つ
+	time.Sleep(50 * time.Millisecond)
+
+	if err := ln.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Read(make([]byte, 1)); !errors.Is(err, ErrConnReset) {
+		t.Fatalf("got %v, want %v", err, ErrConnReset)
+	}
+	s.mu.Lock()
+	n := len(s.conns)
+	s.mu.Unlock()
+	if n != 0 {
+		t.Fatalf("%d connections left in the stack", n)
+	}
+	if _, err := ln.AcceptTCP(); err != ErrListenerClosed {
+		t.Fatalf("got %v, want %v", err, ErrListenerClosed)
+	}
+}
@@ -0,0 +1,68 @@
+package rfc9401
+
+import (
+	"math"
+	"time"
+)
+
+// NewReno はRFC5681のスロースタートと輻輳回避を行う輻輳制御
+type NewReno struct {
+	mss      uint32
+	cwnd     uint32
+	ssthresh uint32
+	// 輻輳回避中にACKされたbyte数。cwnd分たまったら1MSS増やす (RFC5681 3.1 Appropriate Byte Counting)
+	bytesAcked uint32
+}
+
+func (r *NewReno) Init(mss uint32) {
+	r.mss = mss
+	r.cwnd = initialWindow(mss)
+	r.ssthresh = math.MaxUint32
+	r.bytesAcked = 0
+}
+
+func (r *NewReno) Window() uint32 {
+	return r.cwnd
+}
+
+func (r *NewReno) OnAck(acked uint32, srtt time.Duration) {
+	if r.cwnd < r.ssthresh {
+		// スロースタート
+		if acked > r.mss {
+			acked = r.mss
+		}
+		r.cwnd += acked
+		return
+	}
+	// 輻輳回避
+	r.bytesAcked += acked
+	if r.bytesAcked >= r.cwnd {
+		r.bytesAcked -= r.cwnd
+		r.cwnd += r.mss
+	}
+}
+
+func (r *NewReno) EnterRecovery(inFlight uint32) {
+	r.ssthresh = r.halfFlight(inFlight)
+	r.cwnd = r.ssthresh
+	r.bytesAcked = 0
+}
+
+func (r *NewReno) ExitRecovery() {
+	r.cwnd = r.ssthresh
+}
+
+func (r *NewReno) OnTimeout(inFlight uint32) {
+	r.ssthresh = r.halfFlight(inFlight)
+	r.cwnd = r.mss
+	r.bytesAcked = 0
+}
+
+// halfFlight はRFC5681 (4)式 ssthresh = max(FlightSize / 2, 2*SMSS)
+func (r *NewReno) halfFlight(inFlight uint32) uint32 {
+	half := inFlight / 2
+	if half < 2*r.mss {
+		half = 2 * r.mss
+	}
+	return half
+}
@@ -1,8 +1,13 @@
 package rfc9401
 
-import "bytes"
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
 
 const (
+	TCP_Option_End_Of_List          = 0
 	TCP_Option_No_Operation         = 1
 	TCP_OPTION_Maximum_Segment_Size = 2
 	TCP_Option_Window_Scale         = 3
@@ -11,132 +16,271 @@ const (
 	TCP_Option_Timestamps           = 8
 )
 
-type tcpOptions struct {
-	// No Operation
-	nop struct {
-		kind uint8
-	}
-	// Maximum Segment Size
-	mss struct {
-		kind   uint8
-		length uint8
-		value  uint16
-	}
-	// Window Scale
-	windowscale struct {
-		kind       uint8
-		length     uint8
-		shiftcount uint8
-	}
-	// SACK Permitted
-	sackpermitted struct {
-		kind   uint8
-		length uint8
-	}
-	// Timestamps
-	timestamp struct {
-		kind   uint8
-		length uint8
-		value  uint32
-		replay uint32
-	}
-}
-
-func parseTCPOptions(packetOpts []byte) tcpOptions {
-	var tcpopt tcpOptions
-
-	for {
-		if len(packetOpts) == 0 {
-			break
-		} else {
-			switch packetOpts[0] {
-			case TCP_OPTION_Maximum_Segment_Size:
-				tcpopt.mss.kind = packetOpts[0]
-				tcpopt.mss.length = packetOpts[1]
-				tcpopt.mss.value = byteToUint16(packetOpts[2:4])
-				packetOpts = packetOpts[4:]
-			case TCP_Option_SACK_Permitted:
-				tcpopt.sackpermitted.kind = packetOpts[0]
-				tcpopt.sackpermitted.length = packetOpts[1]
-				packetOpts = packetOpts[2:]
-			case TCP_Option_Timestamps:
-				tcpopt.timestamp.kind = packetOpts[0]
-				tcpopt.timestamp.length = packetOpts[1]
-				tcpopt.timestamp.value = byteToUint32(packetOpts[2:6])
-				tcpopt.timestamp.replay = byteToUint32(packetOpts[6:10])
-				packetOpts = packetOpts[10:]
-			case TCP_Option_No_Operation:
-				tcpopt.nop.kind = packetOpts[0]
-				packetOpts = packetOpts[1:]
-			case TCP_Option_Window_Scale:
-				tcpopt.windowscale.kind = packetOpts[0]
-				tcpopt.windowscale.length = packetOpts[1]
-				tcpopt.windowscale.shiftcount = packetOpts[2]
-				packetOpts = packetOpts[3:]
-			}
+// TCPヘッダのオプション部分の最大長 (DataOffsetの最大60byte - 固定部分20byte)
+const maxOptionsLength = 40
+
+var (
+	ErrMalformedOption = errors.New("malformed tcp option")
+	ErrOptionsTooLong  = errors.New("tcp options too long")
+)
+
+// TCPOption はTCPヘッダのオプション1つ
+type TCPOption interface {
+	// Kind はオプションの種類を返す
+	Kind() uint8
+	// Payload はkindとlengthを除いたオプションの中身を返す
+	Payload() []byte
+}
+
+// TCPOptions はヘッダに並んでいる順のオプションのリスト
+type TCPOptions []TCPOption
+
+// EndOfOptionListOption はオプションリストの終わり (kind 0)。これより後ろは読まない
+type EndOfOptionListOption struct{}
+
+func (EndOfOptionListOption) Kind() uint8     { return TCP_Option_End_Of_List }
+func (EndOfOptionListOption) Payload() []byte { return nil }
+
+// NoOperationOption はオプションの区切りや位置合わせに使う1byteのオプション (kind 1)
+type NoOperationOption struct{}
+
+func (NoOperationOption) Kind() uint8     { return TCP_Option_No_Operation }
+func (NoOperationOption) Payload() []byte { return nil }
+
+// MSSOption はMaximum Segment Sizeオプション (RFC9293 3.7.1)
+type MSSOption struct {
+	Value uint16
+}
+
+func (MSSOption) Kind() uint8       { return TCP_OPTION_Maximum_Segment_Size }
+func (o MSSOption) Payload() []byte { return uint16ToByte(o.Value) }
+
+// WindowScaleOption はWindow Scaleオプション (RFC7323 2.2)
+type WindowScaleOption struct {
+	ShiftCount uint8
+}
+
+func (WindowScaleOption) Kind() uint8       { return TCP_Option_Window_Scale }
+func (o WindowScaleOption) Payload() []byte { return []byte{o.ShiftCount} }
+
+// SACKPermittedOption はSACK Permittedオプション (RFC2018 2)
+type SACKPermittedOption struct{}
+
+func (SACKPermittedOption) Kind() uint8     { return TCP_Option_SACK_Permitted }
+func (SACKPermittedOption) Payload() []byte { return nil }
+
+// SACKBlock は受信済みの不連続なデータの範囲[Left, Right)
+type SACKBlock struct {
+	Left  uint32
+	Right uint32
+}
+
+// SACKOption はSACKオプション (RFC2018 3)
+type SACKOption struct {
+	Blocks []SACKBlock
+}
+
+func (SACKOption) Kind() uint8 { return TCP_Option_SACK }
+func (o SACKOption) Payload() []byte {
+	b := make([]byte, 0, 8*len(o.Blocks))
+	for _, block := range o.Blocks {
+		b = append(b, uint32ToByte(block.Left)...)
+		b = append(b, uint32ToByte(block.Right)...)
+	}
+	return b
+}
+
+// TimestampsOption はTimestampsオプション (RFC7323 3.2)
+type TimestampsOption struct {
+	Value     uint32
+	EchoReply uint32
+}
+
+func (TimestampsOption) Kind() uint8 { return TCP_Option_Timestamps }
+func (o TimestampsOption) Payload() []byte {
+	return append(uint32ToByte(o.Value), uint32ToByte(o.EchoReply)...)
+}
+
+// RawOption は登録されていない種類のオプションをそのまま保持する
+type RawOption struct {
+	Type uint8
+	Data []byte
+}
+
+func (o RawOption) Kind() uint8     { return o.Type }
+func (o RawOption) Payload() []byte { return o.Data }
+
+// TCPOptionParser はkindとlengthを除いたオプションの中身をパースする
+type TCPOptionParser func(payload []byte) (TCPOption, error)
+
+var (
+	optionParsersMu sync.RWMutex
+	optionParsers   = map[uint8]TCPOptionParser{
+		TCP_OPTION_Maximum_Segment_Size: parseMSSOption,
+		TCP_Option_Window_Scale:         parseWindowScaleOption,
+		TCP_Option_SACK_Permitted:       parseSACKPermittedOption,
+		TCP_Option_SACK:                 parseSACKOption,
+		TCP_Option_Timestamps:           parseTimestampsOption,
+	}
+)
+
+// RegisterTCPOption はkindのオプションをパースする関数を登録する。
+// 登録されていないkindはRawOptionとして扱われる
+func RegisterTCPOption(kind uint8, parser TCPOptionParser) error {
+	if kind == TCP_Option_End_Of_List || kind == TCP_Option_No_Operation {
+		return fmt.Errorf("can not register tcp option kind %d", kind)
+	}
+	optionParsersMu.Lock()
+	defer optionParsersMu.Unlock()
+	optionParsers[kind] = parser
+	return nil
+}
+
+func parseMSSOption(payload []byte) (TCPOption, error) {
+	if len(payload) != 2 {
+		return nil, ErrMalformedOption
+	}
+	return MSSOption{Value: byteToUint16(payload)}, nil
+}
+
+func parseWindowScaleOption(payload []byte) (TCPOption, error) {
+	if len(payload) != 1 {
+		return nil, ErrMalformedOption
+	}
+	return WindowScaleOption{ShiftCount: payload[0]}, nil
+}
+
+func parseSACKPermittedOption(payload []byte) (TCPOption, error) {
+	if len(payload) != 0 {
+		return nil, ErrMalformedOption
+	}
+	return SACKPermittedOption{}, nil
+}
+
+func parseSACKOption(payload []byte) (TCPOption, error) {
+	if len(payload) == 0 || len(payload)%8 != 0 {
+		return nil, ErrMalformedOption
+	}
+	var opt SACKOption
+	for i := 0; i < len(payload); i += 8 {
+		opt.Blocks = append(opt.Blocks, SACKBlock{
+			Left:  byteToUint32(payload[i : i+4]),
+			Right: byteToUint32(payload[i+4 : i+8]),
+		})
+	}
+	return opt, nil
+}
+
+func parseTimestampsOption(payload []byte) (TCPOption, error) {
+	if len(payload) != 8 {
+		return nil, ErrMalformedOption
+	}
+	return TimestampsOption{
+		Value:     byteToUint32(payload[0:4]),
+		EchoReply: byteToUint32(payload[4:8]),
+	}, nil
+}
+
+// ParseTCPOptions はオプション部分をパースする。
+// End of Option Listが来たらそこで終わり、lengthがおかしいときはそれまでに読めたオプションとエラーを返す
+func ParseTCPOptions(packetOpts []byte) (TCPOptions, error) {
+	var options TCPOptions
+
+	for len(packetOpts) > 0 {
+		kind := packetOpts[0]
+		switch kind {
+		case TCP_Option_End_Of_List:
+			return options, nil
+		case TCP_Option_No_Operation:
+			options = append(options, NoOperationOption{})
+			packetOpts = packetOpts[1:]
+			continue
+		}
+
+		// kindとlengthの2byteを含めた長さ
+		if len(packetOpts) < 2 {
+			return options, fmt.Errorf("%w : kind %d has no length", ErrMalformedOption, kind)
+		}
+		length := int(packetOpts[1])
+		if length < 2 || length > len(packetOpts) {
+			return options, fmt.Errorf("%w : kind %d length %d", ErrMalformedOption, kind, length)
+		}
+		payload := packetOpts[2:length]
+		packetOpts = packetOpts[length:]
+
+		optionParsersMu.RLock()
+		parser, ok := optionParsers[kind]
+		optionParsersMu.RUnlock()
+		if !ok {
+			options = append(options, RawOption{Type: kind, Data: payload})
+			continue
+		}
+		opt, err := parser(payload)
+		if err != nil {
+			return options, fmt.Errorf("kind %d : %w", kind, err)
+		}
+		options = append(options, opt)
+	}
+
+	return options, nil
+}
+
+// Marshal はオプションを並べ、End of Option Listで32bit境界まで埋めてbyteにする
+func (options TCPOptions) Marshal() ([]byte, error) {
+	var b []byte
+
+	for _, opt := range options {
+		switch opt.Kind() {
+		case TCP_Option_End_Of_List, TCP_Option_No_Operation:
+			b = append(b, opt.Kind())
+			continue
 		}
+		payload := opt.Payload()
+		if len(payload) > 0xff-2 {
+			return nil, fmt.Errorf("%w : kind %d", ErrOptionsTooLong, opt.Kind())
+		}
+		b = append(b, opt.Kind(), uint8(len(payload)+2))
+		b = append(b, payload...)
+	}
+	// パディングは0で埋める (RFC9293 3.1)
+	for len(b)%4 != 0 {
+		b = append(b, TCP_Option_End_Of_List)
+	}
+	if len(b) > maxOptionsLength {
+		return nil, fmt.Errorf("%w : %d bytes", ErrOptionsTooLong, len(b))
 	}
 
-	return tcpopt
-}
-
-func (options *tcpOptions) optSYN() []byte {
-	var b bytes.Buffer
-
-	opt := tcpOptions{
-		mss: struct {
-			kind   uint8
-			length uint8
-			value  uint16
-		}{kind: TCP_OPTION_Maximum_Segment_Size, length: 4, value: 65495},
-		sackpermitted: struct {
-			kind   uint8
-			length uint8
-		}{kind: TCP_Option_SACK_Permitted, length: 2},
-		timestamp: struct {
-			kind   uint8
-			length uint8
-			value  uint32
-			replay uint32
-		}{kind: TCP_Option_Timestamps, length: 10, value: 3766008248, replay: 0},
-		nop: struct{ kind uint8 }{kind: TCP_Option_No_Operation},
-		windowscale: struct {
-			kind       uint8
-			length     uint8
-			shiftcount uint8
-		}{kind: TCP_Option_Window_Scale, length: 3, shiftcount: 7},
-	}
-	// Maximum Segment Size
-	b.Write([]byte{opt.mss.kind, opt.mss.length})
-	b.Write(uint16ToByte(opt.mss.value))
-	// SACK Permitted
-	b.Write([]byte{opt.sackpermitted.kind, opt.sackpermitted.length})
-	// Timestamps
-	b.Write([]byte{opt.timestamp.kind, opt.timestamp.length})
-	b.Write(uint32ToByte(opt.timestamp.value))
-	b.Write(uint32ToByte(opt.timestamp.replay))
-	// No Operation
-	b.Write([]byte{opt.nop.kind})
-	// Window Scale
-	b.Write([]byte{opt.windowscale.kind, opt.windowscale.length, opt.windowscale.shiftcount})
-
-	return b.Bytes()
-}
-
-func (options *tcpOptions) optACK(tsval uint32) []byte {
-	var b bytes.Buffer
-	opt := tcpOptions{
-		timestamp: struct {
-			kind   uint8
-			length uint8
-			value  uint32
-			replay uint32
-		}{kind: TCP_Option_Timestamps, length: 10, value: tsval, replay: tsval},
-	}
-	b.Write([]byte{TCP_Option_No_Operation, TCP_Option_No_Operation})
-	b.Write([]byte{opt.timestamp.kind, opt.timestamp.length})
-	b.Write(uint32ToByte(opt.timestamp.value))
-	b.Write(uint32ToByte(opt.timestamp.replay))
-
-	return b.Bytes()
+	return b, nil
+}
+
+// Get はkindのオプションがあれば最初のものを返す
+func (options TCPOptions) Get(kind uint8) TCPOption {
+	for _, opt := range options {
+		if opt.Kind() == kind {
+			return opt
+		}
+	}
+	return nil
+}
+
+// MSS はMSSオプションの値を返す
+func (options TCPOptions) MSS() (uint16, bool) {
+	if opt, ok := options.Get(TCP_OPTION_Maximum_Segment_Size).(MSSOption); ok {
+		return opt.Value, true
+	}
+	return 0, false
+}
+
+// Timestamps はTimestampsオプションを返す
+func (options TCPOptions) Timestamps() (TimestampsOption, bool) {
+	opt, ok := options.Get(TCP_Option_Timestamps).(TimestampsOption)
+	return opt, ok
+}
+
+// WindowScale はWindow Scaleオプションのシフト数を返す
+func (options TCPOptions) WindowScale() (uint8, bool) {
+	if opt, ok := options.Get(TCP_Option_Window_Scale).(WindowScaleOption); ok {
+		return opt.ShiftCount, true
+	}
+	return 0, false
 }
@@ -0,0 +1,115 @@
+package rfc9401
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestParseTCPOptions(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		opts []byte
+		want TCPOptions
+		err  error
+	}{
+		// End of Option Listより後ろは読まない
+		{"end of list", []byte{1, 2, 4, 0x05, 0xb4, 0, 8, 10}, TCPOptions{NoOperationOption{}, MSSOption{Value: 1460}}, nil},
+		{"only end of list", []byte{0, 0, 0, 0}, nil, nil},
+		{"unknown kind", []byte{30, 4, 0xab, 0xcd, 1, 0}, TCPOptions{RawOption{Type: 30, Data: []byte{0xab, 0xcd}}, NoOperationOption{}}, nil},
+		{"no length", []byte{1, 30}, TCPOptions{NoOperationOption{}}, ErrMalformedOption},
+		{"length 0", []byte{30, 0, 0, 0}, nil, ErrMalformedOption},
+		{"length 1", []byte{30, 1, 0, 0}, nil, ErrMalformedOption},
+		{"length beyond options", []byte{2, 4, 0x05, 0xb4, 30, 8, 0, 0}, TCPOptions{MSSOption{Value: 1460}}, ErrMalformedOption},
+		{"bad payload", []byte{2, 3, 0x05, 0}, nil, ErrMalformedOption},
+	} {
+		got, err := ParseTCPOptions(tc.opts)
+		if !errors.Is(err, tc.err) {
+			t.Errorf("%s : got err %v, want %v", tc.name, err, tc.err)
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s : got %#v, want %#v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestMarshalTCPOptions(t *testing.T) {
+	// 知らない種類のオプションも受け取ったときと同じbyteに戻す
+	raw := []byte{30, 5, 1, 2, 3, 1, 4, 2}
+	opts, err := ParseTCPOptions(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := opts.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, raw) {
+		t.Fatalf("got %x, want %x", b, raw)
+	}
+
+	// 4byte境界までEnd of Option Listで埋める
+	b, err = TCPOptions{MSSOption{Value: 1460}, WindowScaleOption{ShiftCount: 7}, EndOfOptionListOption{}}.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []byte{2, 4, 0x05, 0xb4, 3, 3, 7, 0}; !bytes.Equal(b, want) {
+		t.Fatalf("got %x, want %x", b, want)
+	}
+
+	for _, tc := range []struct {
+		name string
+		opts TCPOptions
+	}{
+		{"over 40 bytes", TCPOptions{TimestampsOption{}, SACKOption{Blocks: make([]SACKBlock, 4)}}},
+		{"payload over 253 bytes", TCPOptions{RawOption{Type: 30, Data: make([]byte, 254)}}},
+	} {
+		if _, err := tc.opts.Marshal(); !errors.Is(err, ErrOptionsTooLong) {
+			t.Errorf("%s : got %v, want %v", tc.name, err, ErrOptionsTooLong)
+		}
+	}
+}
+
+// testOption はRegisterTCPOptionで登録するオプション
+type testOption struct {
+	value uint8
+}
+
+func (testOption) Kind() uint8       { return 253 }
+func (o testOption) Payload() []byte { return []byte{o.value} }
+
+func TestRegisterTCPOption(t *testing.T) {
+	if err := RegisterTCPOption(TCP_Option_End_Of_List, nil); err == nil {
+		t.Fatal("registered End of Option List")
+	}
+	if err := RegisterTCPOption(TCP_Option_No_Operation, nil); err == nil {
+		t.Fatal("registered No-Operation")
+	}
+
+	err := RegisterTCPOption(253, func(payload []byte) (TCPOption, error) {
+		if len(payload) != 1 {
+			return nil, ErrMalformedOption
+		}
+		return testOption{value: payload[0]}, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		optionParsersMu.Lock()
+		delete(optionParsers, 253)
+		optionParsersMu.Unlock()
+	})
+
+	opts, err := ParseTCPOptions([]byte{253, 3, 42, 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := opts.Get(253); got != (testOption{value: 42}) {
+		t.Fatalf("got %#v", got)
+	}
+	if _, err := ParseTCPOptions([]byte{253, 4, 42, 43}); !errors.Is(err, ErrMalformedOption) {
+		t.Fatalf("got %v, want %v", err, ErrMalformedOption)
+	}
+}
@@ -0,0 +1,122 @@
+package rfc9401
+
+import "fmt"
+
+// oooBlock はRCV.NXTより先に届いた連続するデータ
+type oooBlock struct {
+	seq  uint32
+	data []byte
+}
+
+func (b *oooBlock) end() uint32 {
+	return b.seq + uint32(len(b.data))
+}
+
+// reassembler は順番が入れ替わって届いたセグメントをシーケンス番号順に並べ直す
+type reassembler struct {
+	// シーケンス番号順に並べ、隣接や重なりのあるブロックはまとめておく
+	blocks []oooBlock
+	// 順番より先に届いたFINのシーケンス番号
+	finSeq   uint32
+	finKnown bool
+	// 最後に並べ直し用に取っておいたセグメントのシーケンス番号。SACKブロックの順番に使う
+	lastSeq uint32
+}
+
+// insert はseqから始まるdataを保持する。既にあるデータと重なる部分はまとめる
+func (r *reassembler) insert(seq uint32, data []byte) {
+	end := seq + uint32(len(data))
+	r.lastSeq = seq
+
+	// 重なるか隣接するブロックの範囲[i, j)を探す
+	i := 0
+	for i < len(r.blocks) && seqLT(r.blocks[i].end(), seq) {
+		i++
+	}
+	j := i
+	for j < len(r.blocks) && seqLE(r.blocks[j].seq, end) {
+		j++
+	}
+
+	newSeq, newEnd := seq, end
+	if i < j {
+		if seqLT(r.blocks[i].seq, newSeq) {
+			newSeq = r.blocks[i].seq
+		}
+		if seqGT(r.blocks[j-1].end(), newEnd) {
+			newEnd = r.blocks[j-1].end()
+		}
+	}
+	merged := make([]byte, newEnd-newSeq)
+	for _, b := range r.blocks[i:j] {
+		copy(merged[b.seq-newSeq:], b.data)
+	}
+	copy(merged[seq-newSeq:], data)
+
+	blocks := append([]oooBlock{}, r.blocks[:i]...)
+	blocks = append(blocks, oooBlock{seq: newSeq, data: merged})
+	r.blocks = append(blocks, r.blocks[j:]...)
+}
+
+// pop はrcvNxtから続くデータがあれば取り出す
+func (r *reassembler) pop(rcvNxt uint32) []byte {
+	for len(r.blocks) > 0 && seqLE(r.blocks[0].seq, rcvNxt) {
+		b := r.blocks[0]
+		r.blocks = r.blocks[1:]
+		if seqGT(b.end(), rcvNxt) {
+			return b.data[rcvNxt-b.seq:]
+		}
+	}
+	return nil
+}
+
+// setFin は届いたFINの位置を覚えておく
+func (r *reassembler) setFin(seq uint32) {
+	r.finSeq = seq
+	r.finKnown = true
+}
+
+// finReady はrcvNxtまでのデータがそろってFINを処理できるかを返す
+func (r *reassembler) finReady(rcvNxt uint32) bool {
+	return r.finKnown && r.finSeq == rcvNxt
+}
+
+// receiveData は受信ウィンドウに収まるようにデータを切り詰め、順番どおりの部分だけを受信バッファに渡す
+func (c *Conn) receiveData(seq uint32, data []byte) {
+	// 既に受け取った部分を取り除く
+	if seqLT(seq, c.rcvNxt) {
+		dup := c.rcvNxt - seq
+		if dup >= uint32(len(data)) {
+			return
+		}
+		data = data[dup:]
+		seq = c.rcvNxt
+	}
+	// ウィンドウからはみ出した部分を取り除く
+	wndEnd := c.rcvNxt + c.rcvWindow()
+	if seqGT(seq+uint32(len(data)), wndEnd) {
+		if seqGE(seq, wndEnd) {
+			return
+		}
+		data = data[:wndEnd-seq]
+	}
+
+	if seq != c.rcvNxt {
+		// 順番より先に届いたので並べ直し用に取っておく
+		c.reasm.insert(seq, data)
+		return
+	}
+
+	fmt.Println("Recv PSHACK packet")
+	c.recvBuf = append(c.recvBuf, data...)
+	c.rcvNxt += uint32(len(data))
+	for {
+		next := c.reasm.pop(c.rcvNxt)
+		if next == nil {
+			break
+		}
+		c.recvBuf = append(c.recvBuf, next...)
+		c.rcvNxt += uint32(len(next))
+	}
+	c.wakeup()
+}
@@ -0,0 +1,44 @@
+package rfc9401
+
+import (
+	"net/netip"
+	"testing"
+)
+
+func TestReassembly(t *testing.T) {
+	a, _ := Pipe(netip.MustParseAddr("192.0.2.1"), netip.MustParseAddr("192.0.2.2"))
+	st := NewStack(a)
+	defer st.Close()
+	c := newConn(st, netip.MustParseAddr("192.0.2.1"), 1)
+	c.remoteIP = netip.MustParseAddr("192.0.2.2")
+	c.rcvNxt = 100
+	c.rcvAdv = 10000
+
+	for _, step := range []struct {
+		seq    uint32
+		data   string
+		want   string
+		rcvNxt uint32
+	}{
+		// 順番の飛んだセグメントは読めるようにならない
+		{110, "klmno", "", 100},
+		{105, "fghijk", "", 100},
+		{120, "uvw", "", 100},
+		// RCV.NXTより前の部分は切り捨てる
+		{98, "xxabc", "abc", 103},
+		// 穴が埋まればつながった分までまとめて読めるようになる
+		{103, "de", "abcdefghijklmno", 115},
+		{115, "pqrst", "abcdefghijklmnopqrstuvw", 123},
+		// 重複したセグメントは無視する
+		{100, "abc", "abcdefghijklmnopqrstuvw", 123},
+	} {
+		c.receiveData(step.seq, []byte(step.data))
+		if string(c.recvBuf) != step.want || c.rcvNxt != step.rcvNxt {
+			t.Fatalf("after %d %q : got %q rcvNxt %d, want %q rcvNxt %d",
+				step.seq, step.data, c.recvBuf, c.rcvNxt, step.want, step.rcvNxt)
+		}
+	}
+	if len(c.reasm.blocks) != 0 {
+		t.Fatalf("%d blocks left", len(c.reasm.blocks))
+	}
+}
@@ -0,0 +1,110 @@
+package rfc9401
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"time"
+)
+
+var (
+	ErrConnReset   = errors.New("connection reset by peer")
+	ErrConnRefused = errors.New("connection refused")
+)
+
+// 1秒あたりに送るチャレンジACKの上限 (RFC5961 7)
+const challengeAckLimit = 100
+
+// resetFor はsegへの応答として送るRSTを作る (RFC9293 3.10.7.1)
+func resetFor(seg *segment) segment {
+	rst := segment{
+		srcPort: seg.dstPort,
+		dstPort: seg.srcPort,
+	}
+	if seg.has(ACK) {
+		rst.seq = seg.ack
+		rst.flags = RST
+	} else {
+		rst.ack = seg.seq + seg.length()
+		rst.flags = RST | ACK
+	}
+	return rst
+}
+
+// sendReset はsrcIPからdstIPに届いたsegへの応答としてRSTを送る。RSTにはRSTを返さない
+func (s *Stack) sendReset(srcIP, dstIP netip.Addr, seg *segment) {
+	if seg.has(RST) {
+		return
+	}
+	rst := resetFor(seg)
+	if err := s.send(dstIP, srcIP, &rst); err != nil {
+		fmt.Printf("send rst err : %v\n", err)
+		return
+	}
+	fmt.Println("Send RST packet")
+}
+
+// allowChallengeAck はチャレンジACKを送ってよいかを返す。
+// 送りすぎて攻撃者にシーケンス番号を推測されないようにStack全体で数を制限する
+func (s *Stack) allowChallengeAck() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(s.challengeAckTime) >= time.Second {
+		s.challengeAckTime = now
+		s.challengeAcks = 0
+	}
+	if s.challengeAcks >= challengeAckLimit {
+		return false
+	}
+	s.challengeAcks++
+	return true
+}
+
+// challengeAck は正しいRCV.NXTとSND.NXTを知らせるACKを送る。
+// 本物の相手であれば正しいシーケンス番号でRSTを送り直してくる (RFC5961 3.2)
+func (c *Conn) challengeAck() {
+	if !c.stack.allowChallengeAck() {
+		return
+	}
+	fmt.Println("Send challenge ACK")
+	c.sendAck()
+}
+
+// reset はRSTを送ってコネクションを破棄する (RFC9293 3.10.5)
+func (c *Conn) reset(err error) {
+	if c.state == StateSynReceived || (c.state.synchronized() && c.state != StateTimeWait) {
+		seg := segment{
+			srcPort: c.localPort,
+			dstPort: c.remotePort,
+			seq:     c.sndNxt,
+			flags:   RST,
+		}
+		if err := c.stack.send(c.localIP, c.remoteIP, &seg); err != nil {
+			fmt.Printf("send rst err : %v\n", err)
+		} else {
+			fmt.Println("Send RST packet")
+		}
+	}
+	c.err = err
+	c.setState(StateClosed)
+}
+
+// handleReset は同期済みの状態で届いたRSTを処理する。
+// シーケンス番号がRCV.NXTと完全に一致するときだけコネクションを破棄し、
+// ウィンドウ内であればチャレンジACKを返す (RFC5961 3.2)
+func (c *Conn) handleReset(seg *segment) {
+	wnd := c.rcvWindow()
+	if wnd == 0 {
+		wnd = 1
+	}
+	switch {
+	case seg.seq == c.rcvNxt:
+		fmt.Println("Recv RST packet")
+		c.err = ErrConnReset
+		c.setState(StateClosed)
+	case seqGT(seg.seq, c.rcvNxt) && seqLT(seg.seq, c.rcvNxt+wnd):
+		c.challengeAck()
+	}
+}
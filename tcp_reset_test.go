@@ -0,0 +1,39 @@
+package rfc9401
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestRefused(t *testing.T) {
+	c, s := pipeStacks(t)
+	s.ResetClosedPorts = true
+	_, err := c.DialTCP(nil, &net.TCPAddr{IP: net.IP{192, 0, 2, 2}, Port: 81})
+	if err != ErrConnRefused {
+		t.Fatalf("got %v, want %v", err, ErrConnRefused)
+	}
+}
+
+func TestReset(t *testing.T) {
+	c, s := pipeStacks(t)
+	conn, srv := dialPipe(t, c, s)
+
+	// RCV.NXTと一致しないRSTではコネクションを破棄しない (RFC5961 3.2)
+	srv.mu.Lock()
+	blind := segment{srcPort: conn.localPort, dstPort: 80, seq: srv.rcvNxt + 100, flags: RST}
+	srv.mu.Unlock()
+	srv.handleSegment(netip.MustParseAddr("192.0.2.1"), blind)
+	if state := srv.State(); state != StateEstablished {
+		t.Fatalf("blind reset accepted : server is in %s", state)
+	}
+
+	conn.mu.Lock()
+	conn.reset(ErrConnClosed)
+	conn.mu.Unlock()
+	srv.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := srv.Read(make([]byte, 1)); err != ErrConnReset {
+		t.Fatalf("got %v, want %v", err, ErrConnReset)
+	}
+}
@@ -0,0 +1,200 @@
+package rfc9401
+
+import (
+	"errors"
+	"time"
+)
+
+// RFC6298の再送タイマのパラメータ
+const (
+	initialRTO = 1 * time.Second
+	minRTO     = 1 * time.Second
+	maxRTO     = 60 * time.Second
+	// clock granularity
+	rtoGranularity = time.Millisecond
+	// 再送を諦めるまでの回数のデフォルト
+	defaultMaxRetries = 8
+)
+
+var ErrRetransmitTimeout = errors.New("retransmission timeout")
+
+// rtoEstimator はRFC6298に従ってSRTTとRTTVARからRTOを計算する
+type rtoEstimator struct {
+	srtt     time.Duration
+	rttvar   time.Duration
+	rto      time.Duration
+	measured bool
+}
+
+func newRTOEstimator() rtoEstimator {
+	return rtoEstimator{rto: initialRTO}
+}
+
+// sample は計測したRTTでSRTTとRTTVARを更新する (RFC6298 2.2, 2.3)
+func (e *rtoEstimator) sample(rtt time.Duration) {
+	if !e.measured {
+		e.srtt = rtt
+		e.rttvar = rtt / 2
+		e.measured = true
+	} else {
+		diff := e.srtt - rtt
+		if diff < 0 {
+			diff = -diff
+		}
+		// alpha=1/8, beta=1/4
+		e.rttvar = (3*e.rttvar + diff) / 4
+		e.srtt = (7*e.srtt + rtt) / 8
+	}
+
+	variance := 4 * e.rttvar
+	if variance < rtoGranularity {
+		variance = rtoGranularity
+	}
+	e.setRTO(e.srtt + variance)
+}
+
+// backoff はタイムアウトしたときにRTOを2倍にする (RFC6298 5.5)
+func (e *rtoEstimator) backoff() {
+	e.setRTO(e.rto * 2)
+}
+
+func (e *rtoEstimator) setRTO(rto time.Duration) {
+	if rto < minRTO {
+		rto = minRTO
+	}
+	if rto > maxRTO {
+		rto = maxRTO
+	}
+	e.rto = rto
+}
+
+// txSegment はACKを待っている送信済みセグメント
+type txSegment struct {
+	seq    uint32
+	flags  uint8
+	data   []byte
+	sentAt time.Time
+	// 再送したセグメントはKarnのアルゴリズムによりRTTの計測に使わない
+	retransmitted bool
+	// 相手がSACKで受け取ったと知らせてきた
+	sacked bool
+	// SACKによる損失回復中に再送した
+	resent bool
+	// 死亡フラグを立てて送った
+	dth bool
+}
+
+// end はこのセグメントの次のシーケンス番号を返す
+func (tx *txSegment) end() uint32 {
+	end := tx.seq + uint32(len(tx.data))
+	if tx.flags&SYN != 0 {
+		end++
+	}
+	if tx.flags&FIN != 0 {
+		end++
+	}
+	return end
+}
+
+// transmit はシーケンス番号を消費するセグメントを送り、ACKが来るまで再送キューに入れる
+func (c *Conn) transmit(seq uint32, flags uint8, data []byte) error {
+	dth := c.raiseDeathFlag(seq, flags, data)
+	if err := c.writeSegment(seq, flags, data, dth); err != nil {
+		return err
+	}
+	c.rtxQueue = append(c.rtxQueue, &txSegment{
+		seq:    seq,
+		flags:  flags,
+		data:   data,
+		sentAt: time.Now(),
+		dth:    dth,
+	})
+	if c.rtxTimer == nil {
+		c.startRetransmitTimer()
+	}
+	return nil
+}
+
+// ackRetransmitQueue はackまでのセグメントを再送キューから取り除く
+func (c *Conn) ackRetransmitQueue(ack uint32) {
+	now := time.Now()
+	acked := false
+	for len(c.rtxQueue) > 0 && seqLE(c.rtxQueue[0].end(), ack) {
+		tx := c.rtxQueue[0]
+		// タイムスタンプが使えるときはそちらで計測する
+		if !tx.retransmitted && !c.tsEnabled {
+			c.rto.sample(now.Sub(tx.sentAt))
+		}
+		c.rtxQueue = c.rtxQueue[1:]
+		acked = true
+	}
+	if !acked {
+		return
+	}
+
+	// 新しいデータがACKされたら再送回数をリセットしてタイマをかけ直す (RFC6298 5.3)
+	c.retries = 0
+	if len(c.rtxQueue) == 0 {
+		c.stopRetransmitTimer()
+	} else {
+		c.startRetransmitTimer()
+	}
+}
+
+// retransmitHead は一番古い未ACKのセグメントを再送する
+func (c *Conn) retransmitHead() error {
+	return c.retransmitSegment(c.rtxQueue[0])
+}
+
+func (c *Conn) retransmitSegment(tx *txSegment) error {
+	tx.retransmitted = true
+	return c.writeSegment(tx.seq, tx.flags, tx.data, tx.dth)
+}
+
+func (c *Conn) startRetransmitTimer() {
+	c.stopRetransmitTimer()
+	// 止めたタイマのコールバックが後から走っても無視できるように世代を数える
+	c.rtxGeneration++
+	generation := c.rtxGeneration
+	c.rtxTimer = time.AfterFunc(c.rto.rto, func() {
+		c.onRetransmitTimeout(generation)
+	})
+}
+
+func (c *Conn) stopRetransmitTimer() {
+	if c.rtxTimer != nil {
+		c.rtxTimer.Stop()
+		c.rtxTimer = nil
+	}
+}
+
+// onRetransmitTimeout は一番古い未ACKのセグメントを再送する。
+// 最大回数を超えたらコネクションを破棄する
+func (c *Conn) onRetransmitTimeout(generation uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if generation != c.rtxGeneration || len(c.rtxQueue) == 0 || c.state == StateClosed {
+		return
+	}
+	c.rtxTimer = nil
+
+	c.retries++
+	if c.retries > c.stack.maxRetries() {
+		c.err = ErrRetransmitTimeout
+		c.setState(StateClosed)
+		return
+	}
+
+	// ゼロウィンドウプローブのタイムアウトは輻輳とみなさない
+	if c.state.synchronized() && c.sndWnd != 0 {
+		c.onTimeoutCongestion()
+	}
+	if err := c.retransmitHead(); err != nil {
+		c.err = err
+		c.setState(StateClosed)
+		return
+	}
+	c.rto.backoff()
+	c.startRetransmitTimer()
+}
@@ -0,0 +1,57 @@
+package rfc9401
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestRetransmit(t *testing.T) {
+	synDropped, dataDropped := 0, 0
+	c, s := lossyStacks(t, func(seg segment) bool {
+		if seg.has(SYN) && synDropped < 1 {
+			synDropped++
+			return true
+		}
+		if len(seg.data) > 0 && dataDropped < 2 {
+			dataDropped++
+			return true
+		}
+		return false
+	})
+	ln, err := s.ListenTCP(&net.TCPAddr{Port: 80})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go echoServer(ln)
+
+	conn, err := c.DialTCP(nil, &net.TCPAddr{IP: net.IP{192, 0, 2, 2}, Port: 80})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(20 * time.Second))
+	if _, err := conn.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "hello" {
+		t.Fatalf("got %q", buf)
+	}
+	if synDropped != 1 || dataDropped != 2 {
+		t.Fatalf("dropped %d SYN and %d data segments", synDropped, dataDropped)
+	}
+	conn.Close()
+}
+
+func TestRetransmitGiveUp(t *testing.T) {
+	c, _ := lossyStacks(t, func(seg segment) bool { return true })
+	c.MaxRetries = 2
+	_, err := c.DialTCP(nil, &net.TCPAddr{IP: net.IP{192, 0, 2, 2}, Port: 80})
+	if err != ErrRetransmitTimeout {
+		t.Fatalf("got %v, want %v", err, ErrRetransmitTimeout)
+	}
+}
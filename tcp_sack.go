@@ -0,0 +1,162 @@
+package rfc9401
+
+import "fmt"
+
+// 1つのACKで送るSACKブロックの最大数 (オプション長40byteに収まる数)
+const maxSACKBlocks = 4
+
+// negotiateSACK は相手のSYNにSACK Permittedオプションがあれば有効にする (RFC2018 2)
+func (c *Conn) negotiateSACK(seg *segment) {
+	c.sackEnabled = seg.options.Get(TCP_Option_SACK_Permitted) != nil
+}
+
+// sackBlocks は並べ直し待ちのデータをSACKブロックにする。
+// 最後に受け取ったセグメントを含むブロックを先頭にする (RFC2018 4)
+func (r *reassembler) sackBlocks(max int) []SACKBlock {
+	var blocks []SACKBlock
+	for _, b := range r.blocks {
+		if seqLE(b.seq, r.lastSeq) && seqLT(r.lastSeq, b.end()) {
+			blocks = append(blocks, SACKBlock{Left: b.seq, Right: b.end()})
+			break
+		}
+	}
+	// 残りは新しいデータに近い方から入れる
+	for i := len(r.blocks) - 1; i >= 0 && len(blocks) < max; i-- {
+		b := r.blocks[i]
+		if len(blocks) > 0 && blocks[0].Left == b.seq {
+			continue
+		}
+		blocks = append(blocks, SACKBlock{Left: b.seq, Right: b.end()})
+	}
+	if len(blocks) > max {
+		blocks = blocks[:max]
+	}
+	return blocks
+}
+
+// addSACKOption は順番より先に受け取ったデータがあれば、残りのオプション長に収まるだけSACKブロックをつける
+func (c *Conn) addSACKOption(seg *segment) {
+	if !c.sackEnabled || len(c.reasm.blocks) == 0 {
+		return
+	}
+	used, err := seg.options.Marshal()
+	if err != nil {
+		return
+	}
+	// NOP2つとkind, lengthの4byteの後にブロックが8byteずつ並ぶ
+	max := (maxOptionsLength - len(used) - 4) / 8
+	if max > maxSACKBlocks {
+		max = maxSACKBlocks
+	}
+	if max <= 0 {
+		return
+	}
+	seg.options = append(seg.options, NoOperationOption{}, NoOperationOption{}, SACKOption{Blocks: c.reasm.sackBlocks(max)})
+}
+
+// updateScoreboard はACKのSACKブロックで覆われた送信済みセグメントに印をつける
+func (c *Conn) updateScoreboard(seg *segment) {
+	opt, ok := seg.options.Get(TCP_Option_SACK).(SACKOption)
+	if !ok {
+		return
+	}
+	for _, block := range opt.Blocks {
+		// 既にACKされた範囲や送っていない範囲を指すブロックは無視する
+		if seqLE(block.Right, seg.ack) || seqGT(block.Right, c.sndNxt) || seqGE(block.Left, block.Right) {
+			continue
+		}
+		for _, tx := range c.rtxQueue {
+			if seqGE(tx.seq, block.Right) {
+				break
+			}
+			if seqGE(tx.seq, block.Left) && seqLE(tx.end(), block.Right) {
+				tx.sacked = true
+			}
+		}
+	}
+}
+
+// clearScoreboard は受信側がSACKしたデータを捨てている場合に備え、再送タイムアウトでSACKの情報を消す (RFC2018 8)
+func (c *Conn) clearScoreboard() {
+	for _, tx := range c.rtxQueue {
+		tx.sacked = false
+	}
+}
+
+// lostSegments はRFC6675 4のIsLostでそれぞれのセグメントが失われたかを判定する。
+// 後ろにDupThresh個以上のSACKされたセグメントか(DupThresh-1)*SMSSより多いSACKされたデータがあれば失われたとみなす
+func (c *Conn) lostSegments() []bool {
+	lost := make([]bool, len(c.rtxQueue))
+	sackedSegs, sackedBytes := 0, 0
+	for i := len(c.rtxQueue) - 1; i >= 0; i-- {
+		tx := c.rtxQueue[i]
+		if tx.sacked {
+			sackedSegs++
+			sackedBytes += len(tx.data)
+			continue
+		}
+		lost[i] = sackedSegs >= dupAckThreshold || sackedBytes > (dupAckThreshold-1)*int(c.sndMSS)
+	}
+	return lost
+}
+
+// pipe はRFC6675 4のSetPipeでネットワーク上にあると見積もられるデータの量を返す
+func (c *Conn) pipe() uint32 {
+	lost := c.lostSegments()
+	var pipe uint32
+	for i, tx := range c.rtxQueue {
+		if tx.sacked {
+			continue
+		}
+		if !lost[i] {
+			pipe += uint32(len(tx.data))
+		}
+		if tx.resent {
+			pipe += uint32(len(tx.data))
+		}
+	}
+	return pipe
+}
+
+// sackRecovering はSACKを使った損失回復中かどうかを返す
+func (c *Conn) sackRecovering() bool {
+	return c.sackEnabled && c.inRecovery && !c.rtoRecovery
+}
+
+// enterSACKRecovery はSACKによる損失回復を始め、最初の失われたセグメントを再送する (RFC6675 5 (4))
+func (c *Conn) enterSACKRecovery() {
+	for _, tx := range c.rtxQueue {
+		tx.resent = false
+	}
+	c.sackRetransmit(true)
+}
+
+// sackRetransmit はcwndからpipeを引いた余裕がある間、失われたセグメントを再送する (RFC6675 5 (C))。
+// forceがtrueなら1つ目はcwndに関係なく送る
+func (c *Conn) sackRetransmit(force bool) {
+	lost := c.lostSegments()
+	for i, tx := range c.rtxQueue {
+		if tx.sacked || tx.resent || !(lost[i] || (force && i == 0)) {
+			continue
+		}
+		if !force && c.sackWindow() < uint32(c.sndMSS) {
+			return
+		}
+		force = false
+		fmt.Println("Retransmit lost segment")
+		tx.resent = true
+		if err := c.retransmitSegment(tx); err != nil {
+			return
+		}
+	}
+}
+
+// sackWindow はSACKによる損失回復中に送れるデータの量を返す
+func (c *Conn) sackWindow() uint32 {
+	cwnd := c.cc.Window()
+	pipe := c.pipe()
+	if pipe >= cwnd {
+		return 0
+	}
+	return cwnd - pipe
+}
@@ -0,0 +1,47 @@
+package rfc9401
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestSACKRecovery(t *testing.T) {
+	n := 0
+	c, s := lossyStacks(t, func(seg segment) bool {
+		if len(seg.data) > 0 {
+			n++
+			// 1つのウィンドウの中で飛び飛びに3つ落とす
+			return n == 10 || n == 12 || n == 14
+		}
+		return false
+	})
+	ln, err := s.ListenTCP(&net.TCPAddr{Port: 80})
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan []byte)
+	go sinkServer(ln, done)
+
+	conn, err := c.DialTCP(nil, &net.TCPAddr{IP: net.IP{192, 0, 2, 2}, Port: 80})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !conn.sackEnabled {
+		t.Fatal("SACK is not negotiated")
+	}
+	start := time.Now()
+	payload := make([]byte, 200000)
+	for i := range payload {
+		payload[i] = byte(i)
+	}
+	conn.Write(payload)
+	conn.Close()
+	if got := <-done; !bytes.Equal(got, payload) {
+		t.Fatalf("received %d bytes, want %d", len(got), len(payload))
+	}
+	if elapsed := time.Since(start); elapsed > 900*time.Millisecond {
+		t.Fatalf("took %v", elapsed)
+	}
+}
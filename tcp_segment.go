@@ -0,0 +1,276 @@
+package rfc9401
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"rfc9401/checksum"
+	"sync"
+)
+
+// TCPヘッダの固定部分の長さ
+const tcpHeaderLength = 20
+
+var (
+	ErrSegmentTooShort   = errors.New("tcp segment too short")
+	ErrInvalidDataOffset = errors.New("invalid tcp data offset")
+	ErrInvalidChecksum   = errors.New("invalid tcp checksum")
+)
+
+// Segment はTCPセグメントのヘッダを数値にしたもの。
+// DecodeFromとAppendToはメモリを確保しないので、1パケットごとに使い回せる
+type Segment struct {
+	SrcPort uint16
+	DstPort uint16
+	Seq     uint32
+	Ack     uint32
+	// DataOffset はオプションを含めたヘッダ長をbyteで表したもの。AppendToはOptionsから計算する
+	DataOffset int
+	DTH        bool
+	Flags      uint8
+	Window     uint16
+	Checksum   uint16
+	Urgent     uint16
+	// Options はオプションのbyte列。中身はParseOptionsで読む
+	Options []byte
+	Data    []byte
+}
+
+// ParseSegment はsrcからdstに届いたTCPセグメントを読み、長さとデータオフセット、
+// 疑似ヘッダを含めたチェックサム、オプションを確かめる。
+// チェックサムには疑似ヘッダが要るのでIPアドレスも渡す。StackのChecksumPolicyに関わらず、チェックサムが合わなければエラーにする。
+// エラーはErrSegmentTooShort, ErrInvalidDataOffset, ErrInvalidChecksum, ErrMalformedOptionのどれかをラップする。
+// DataとOptionsはbを参照するので、bを使い回すときはコピーすること
+func ParseSegment(b []byte, src, dst netip.Addr) (*Segment, error) {
+	seg := new(Segment)
+	if err := seg.DecodeFrom(b); err != nil {
+		return nil, err
+	}
+	if err := VerifyChecksum(b, src, dst); err != nil {
+		return nil, err
+	}
+	if _, err := seg.ParseOptions(); err != nil {
+		return nil, err
+	}
+	return seg, nil
+}
+
+// DecodeFrom はbを読んでsegに入れる。チェックサムは確かめず、オプションは長さだけを確かめる。
+// DataとOptionsはbを参照する
+func (seg *Segment) DecodeFrom(b []byte) error {
+	if len(b) < tcpHeaderLength {
+		return fmt.Errorf("%w : %d bytes", ErrSegmentTooShort, len(b))
+	}
+	// 上位4bitが32bit単位のヘッダ長なのでbyteに直す
+	offset := int(b[12]>>4) * 4
+	if offset < tcpHeaderLength || offset > len(b) {
+		return fmt.Errorf("%w : %d bytes in %d bytes segment", ErrInvalidDataOffset, offset, len(b))
+	}
+	if err := checkOptionLengths(b[tcpHeaderLength:offset]); err != nil {
+		return err
+	}
+
+	seg.SrcPort = byteToUint16(b[0:2])
+	seg.DstPort = byteToUint16(b[2:4])
+	seg.Seq = byteToUint32(b[4:8])
+	seg.Ack = byteToUint32(b[8:12])
+	seg.DataOffset = offset
+	seg.DTH = b[12]&0x08 != 0
+	seg.Flags = b[13]
+	seg.Window = byteToUint16(b[14:16])
+	seg.Checksum = byteToUint16(b[16:18])
+	seg.Urgent = byteToUint16(b[18:20])
+	seg.Options = b[tcpHeaderLength:offset]
+	seg.Data = b[offset:]
+
+	return nil
+}
+
+// AppendTo はsegをエンコードしてdstの後ろに足す。オプションは4byte境界まで0で埋め、
+// チェックサムはsegのChecksumをそのまま書くので、送る前にPutChecksumで計算する
+func (seg *Segment) AppendTo(dst []byte) ([]byte, error) {
+	optLen := (len(seg.Options) + 3) &^ 3
+	if optLen > maxOptionsLength {
+		return dst, fmt.Errorf("%w : %d bytes", ErrOptionsTooLong, len(seg.Options))
+	}
+	offset := tcpHeaderLength + optLen
+	dataOffset := uint8(offset/4) << 4
+	// 死亡フラグはData Offsetのすぐ後ろ、予約ビットの最上位 (RFC9401)
+	if seg.DTH {
+		dataOffset |= 0x08
+	}
+
+	dst = append(dst,
+		byte(seg.SrcPort>>8), byte(seg.SrcPort),
+		byte(seg.DstPort>>8), byte(seg.DstPort),
+		byte(seg.Seq>>24), byte(seg.Seq>>16), byte(seg.Seq>>8), byte(seg.Seq),
+		byte(seg.Ack>>24), byte(seg.Ack>>16), byte(seg.Ack>>8), byte(seg.Ack),
+		dataOffset, seg.Flags,
+		byte(seg.Window>>8), byte(seg.Window),
+		byte(seg.Checksum>>8), byte(seg.Checksum),
+		byte(seg.Urgent>>8), byte(seg.Urgent),
+	)
+	dst = append(dst, seg.Options...)
+	for i := len(seg.Options); i < optLen; i++ {
+		dst = append(dst, TCP_Option_End_Of_List)
+	}
+	return append(dst, seg.Data...), nil
+}
+
+// ParseOptions はOptionsをTCPOptionsにする
+func (seg *Segment) ParseOptions() (TCPOptions, error) {
+	return ParseTCPOptions(seg.Options)
+}
+
+// checkOptionLengths はオプションの長さがヘッダに収まっているかだけを確かめる
+func checkOptionLengths(b []byte) error {
+	for len(b) > 0 {
+		switch b[0] {
+		case TCP_Option_End_Of_List:
+			return nil
+		case TCP_Option_No_Operation:
+			b = b[1:]
+			continue
+		}
+		if len(b) < 2 || b[1] < 2 || int(b[1]) > len(b) {
+			return fmt.Errorf("%w : kind %d", ErrMalformedOption, b[0])
+		}
+		b = b[b[1]:]
+	}
+	return nil
+}
+
+// checkHeaderLength はbが固定長のTCPヘッダを含むかを確かめる
+func checkHeaderLength(b []byte) error {
+	if len(b) < tcpHeaderLength {
+		return fmt.Errorf("%w : %d bytes", ErrSegmentTooShort, len(b))
+	}
+	return nil
+}
+
+// PutChecksum はエンコードしたセグメントbに疑似ヘッダを含めたチェックサムを計算して書き込む。
+// bが20byteより短ければErrSegmentTooShortを返す
+func PutChecksum(b []byte, src, dst netip.Addr) error {
+	if err := checkHeaderLength(b); err != nil {
+		return err
+	}
+	b[16], b[17] = 0, 0
+	sum := checksum.Checksum(checksum.PseudoHeader(src, dst, IPProtocolTCP, len(b)), b)
+	b[16], b[17] = byte(sum>>8), byte(sum)
+	return nil
+}
+
+// UpdateAck はエンコードしたセグメントbの確認応答番号とウィンドウを書き換え、
+// チェックサムは全体を足し直さずに変わった分だけ更新する (RFC1624)。
+// bが20byteより短ければErrSegmentTooShortを返す
+func UpdateAck(b []byte, ack uint32, window uint16) error {
+	if err := checkHeaderLength(b); err != nil {
+		return err
+	}
+	sum := byteToUint16(b[16:18])
+	sum = checksum.Update32(sum, byteToUint32(b[8:12]), ack)
+	sum = checksum.Update16(sum, byteToUint16(b[14:16]), window)
+	b[8], b[9], b[10], b[11] = byte(ack>>24), byte(ack>>16), byte(ack>>8), byte(ack)
+	b[14], b[15] = byte(window>>8), byte(window)
+	b[16], b[17] = byte(sum>>8), byte(sum)
+	return nil
+}
+
+// VerifyChecksum は疑似ヘッダとセグメントbを足してチェックサムが合っているかを確かめる。
+// bが20byteより短ければErrSegmentTooShortを返す
+func VerifyChecksum(b []byte, src, dst netip.Addr) error {
+	if err := checkHeaderLength(b); err != nil {
+		return err
+	}
+	// チェックサムを含めて足すと0xffffになる
+	if checksum.Fold(checksum.Add(checksum.PseudoHeader(src, dst, IPProtocolTCP, len(b)), b)) != 0xffff {
+		return fmt.Errorf("%w : %#04x from %s", ErrInvalidChecksum, byteToUint16(b[16:18]), src)
+	}
+	return nil
+}
+
+// isPartialChecksum はチェックサムに疑似ヘッダの和だけが入っているかを返す。
+// ループバックではカーネルがチェックサムの計算をNICに任せたまま(CHECKSUM_PARTIAL)raw socketに渡してくる
+func isPartialChecksum(b []byte, src, dst netip.Addr) bool {
+	return len(b) >= tcpHeaderLength && byteToUint16(b[16:18]) == checksum.Fold(checksum.PseudoHeader(src, dst, IPProtocolTCP, len(b)))
+}
+
+// packetBufferPool はセグメントを組み立てるバッファを使い回す
+var packetBufferPool = sync.Pool{
+	New: func() any {
+		b := make([]byte, 0, 2048)
+		return &b
+	},
+}
+
+func getPacketBuffer() *[]byte {
+	return packetBufferPool.Get().(*[]byte)
+}
+
+func putPacketBuffer(b *[]byte) {
+	*b = (*b)[:0]
+	packetBufferPool.Put(b)
+}
+
+// segment はステートマシンで扱う形にする。オプションはここで読む
+func (seg *Segment) segment() (segment, error) {
+	options, err := seg.ParseOptions()
+	if err != nil {
+		return segment{}, err
+	}
+	return segment{
+		srcPort: seg.SrcPort,
+		dstPort: seg.DstPort,
+		seq:     seg.Seq,
+		ack:     seg.Ack,
+		dth:     seg.DTH,
+		flags:   seg.Flags,
+		window:  seg.Window,
+		options: options,
+		data:    seg.Data,
+	}, nil
+}
+
+// segment はステートマシンで扱うためにSegmentのオプションを解析したもの
+type segment struct {
+	srcPort uint16
+	dstPort uint16
+	seq     uint32
+	ack     uint32
+	dth     bool
+	flags   uint8
+	window  uint16
+	options TCPOptions
+	data    []byte
+}
+
+func (seg *segment) has(flag uint8) bool {
+	return seg.flags&flag != 0
+}
+
+// length はシーケンス番号空間で消費する長さを返す(SYNとFINは1つ分)
+func (seg *segment) length() uint32 {
+	l := uint32(len(seg.data))
+	if seg.has(SYN) {
+		l++
+	}
+	if seg.has(FIN) {
+		l++
+	}
+	return l
+}
+
+// wire は送るためのSegmentにする。optionsはエンコードしたオプション
+func (seg *segment) wire(options []byte) Segment {
+	return Segment{
+		SrcPort: seg.srcPort,
+		DstPort: seg.dstPort,
+		Seq:     seg.seq,
+		Ack:     seg.ack,
+		DTH:     seg.dth,
+		Flags:   seg.flags,
+		Window:  seg.window,
+		Options: options,
+		Data:    seg.data,
+	}
+}
@@ -0,0 +1,155 @@
+package rfc9401
+
+import (
+	"errors"
+	"math/rand"
+	"net/netip"
+	"testing"
+)
+
+func TestParseSegment(t *testing.T) {
+	src := netip.MustParseAddr("192.0.2.1")
+	dst := netip.MustParseAddr("192.0.2.2")
+	options, err := TCPOptions{MSSOption{Value: 1000}}.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	seg := Segment{SrcPort: 1, DstPort: 2, Seq: 3, Flags: ACK, Options: options, Data: []byte("hello")}
+	packet, err := seg.AppendTo(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := PutChecksum(packet, src, dst); err != nil {
+		t.Fatal(err)
+	}
+
+	parsed, err := ParseSegment(packet, src, dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(parsed.Data) != "hello" || parsed.DataOffset != 24 {
+		t.Fatalf("got data %q offset %d", parsed.Data, parsed.DataOffset)
+	}
+	// 疑似ヘッダは送信元と宛先を入れ替えても和が変わらない
+	if _, err := ParseSegment(packet, dst, src); err != nil {
+		t.Fatalf("swapped addresses : %v", err)
+	}
+
+	corrupt := func(f func(b []byte)) []byte {
+		b := append([]byte(nil), packet...)
+		f(b)
+		return b
+	}
+	for _, tc := range []struct {
+		name   string
+		packet []byte
+		want   error
+	}{
+		{"short", packet[:10], ErrSegmentTooShort},
+		{"offset below header", corrupt(func(b []byte) { b[12] = 0x10 }), ErrInvalidDataOffset},
+		{"offset beyond segment", corrupt(func(b []byte) { b[12] = 0xf0 }), ErrInvalidDataOffset},
+		{"flipped bit", corrupt(func(b []byte) { b[25] ^= 1 }), ErrInvalidChecksum},
+	} {
+		if _, err := ParseSegment(tc.packet, src, dst); !errors.Is(err, tc.want) {
+			t.Errorf("%s : got %v, want %v", tc.name, err, tc.want)
+		}
+	}
+}
+
+func TestUpdateAck(t *testing.T) {
+	src := netip.MustParseAddr("2001:db8::1")
+	dst := netip.MustParseAddr("2001:db8::2")
+	seg := Segment{SrcPort: 1, DstPort: 2, Seq: 3, Ack: 4, Window: 5, Flags: ACK, Data: []byte("abc")}
+	packet, err := seg.AppendTo(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := PutChecksum(packet, src, dst); err != nil {
+		t.Fatal(err)
+	}
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 1000; i++ {
+		ack, window := r.Uint32(), uint16(r.Uint32())
+		if err := UpdateAck(packet, ack, window); err != nil {
+			t.Fatal(err)
+		}
+		if err := VerifyChecksum(packet, src, dst); err != nil {
+			t.Fatalf("ack %d window %d : %v", ack, window, err)
+		}
+	}
+}
+
+func TestChecksumShortSegment(t *testing.T) {
+	src := netip.MustParseAddr("192.0.2.1")
+	dst := netip.MustParseAddr("192.0.2.2")
+	for _, b := range [][]byte{nil, make([]byte, 10), make([]byte, tcpHeaderLength-1)} {
+		if err := PutChecksum(b, src, dst); !errors.Is(err, ErrSegmentTooShort) {
+			t.Errorf("PutChecksum(%d bytes) = %v", len(b), err)
+		}
+		if err := UpdateAck(b, 1, 1); !errors.Is(err, ErrSegmentTooShort) {
+			t.Errorf("UpdateAck(%d bytes) = %v", len(b), err)
+		}
+		if err := VerifyChecksum(b, src, dst); !errors.Is(err, ErrSegmentTooShort) {
+			t.Errorf("VerifyChecksum(%d bytes) = %v", len(b), err)
+		}
+	}
+}
+
+// benchSegment はタイムスタンプ付きでMSSいっぱいのデータを持つセグメント
+func benchSegment() Segment {
+	return Segment{
+		SrcPort: 40000,
+		DstPort: 80,
+		Seq:     1,
+		Ack:     1,
+		Flags:   ACK | PSH,
+		Window:  65535,
+		// NOP NOP Timestamps
+		Options: []byte{1, 1, 8, 10, 0, 0, 0, 1, 0, 0, 0, 2},
+		Data:    make([]byte, 1448),
+	}
+}
+
+func BenchmarkSegmentAppendTo(b *testing.B) {
+	src := netip.MustParseAddr("192.0.2.1")
+	dst := netip.MustParseAddr("192.0.2.2")
+	seg := benchSegment()
+	buf := make([]byte, 0, 2048)
+
+	b.ReportAllocs()
+	b.SetBytes(int64(tcpHeaderLength + len(seg.Options) + len(seg.Data)))
+	for i := 0; i < b.N; i++ {
+		packet, err := seg.AppendTo(buf[:0])
+		if err != nil {
+			b.Fatal(err)
+		}
+		if err := PutChecksum(packet, src, dst); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkSegmentDecodeFrom(b *testing.B) {
+	src := netip.MustParseAddr("192.0.2.1")
+	dst := netip.MustParseAddr("192.0.2.2")
+	seg := benchSegment()
+	packet, err := seg.AppendTo(nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+	if err := PutChecksum(packet, src, dst); err != nil {
+		b.Fatal(err)
+	}
+
+	var decoded Segment
+	b.ReportAllocs()
+	b.SetBytes(int64(len(packet)))
+	for i := 0; i < b.N; i++ {
+		if err := decoded.DecodeFrom(packet); err != nil {
+			b.Fatal(err)
+		}
+		if err := VerifyChecksum(packet, src, dst); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package rfc9401
+
+// ConnState はRFC9293で定義されているTCPコネクションの状態
+type ConnState int
+
+const (
+	StateClosed ConnState = iota
+	StateListen
+	StateSynSent
+	StateSynReceived
+	StateEstablished
+	StateFinWait1
+	StateFinWait2
+	StateCloseWait
+	StateClosing
+	StateLastAck
+	StateTimeWait
+)
+
+func (s ConnState) String() string {
+	switch s {
+	case StateClosed:
+		return "CLOSED"
+	case StateListen:
+		return "LISTEN"
+	case StateSynSent:
+		return "SYN-SENT"
+	case StateSynReceived:
+		return "SYN-RECEIVED"
+	case StateEstablished:
+		return "ESTABLISHED"
+	case StateFinWait1:
+		return "FIN-WAIT-1"
+	case StateFinWait2:
+		return "FIN-WAIT-2"
+	case StateCloseWait:
+		return "CLOSE-WAIT"
+	case StateClosing:
+		return "CLOSING"
+	case StateLastAck:
+		return "LAST-ACK"
+	case StateTimeWait:
+		return "TIME-WAIT"
+	}
+	return "UNKNOWN"
+}
+
+// synchronized はSYNの交換が終わっている状態かどうかを返す
+func (s ConnState) synchronized() bool {
+	return s >= StateEstablished
+}
@@ -0,0 +1,93 @@
+package rfc9401
+
+import (
+	"math/rand"
+	"time"
+)
+
+// TS.Recentが古くなったとみなす時間 (RFC7323 5.5)
+const pawsIdleTime = 24 * 24 * time.Hour
+
+// tsClock はコネクションごとの1ms単位のタイムスタンプクロック。
+// 単調増加する時計から作り、コネクションごとにランダムなオフセットを足す (RFC7323 5.4)
+type tsClock struct {
+	start  time.Time
+	offset uint32
+}
+
+func newTSClock() tsClock {
+	return tsClock{start: time.Now(), offset: rand.Uint32()}
+}
+
+// now は現在のTSvalを返す
+func (clock *tsClock) now() uint32 {
+	return clock.offset + uint32(time.Since(clock.start)/time.Millisecond)
+}
+
+// negotiateTimestamps は相手のSYNにTimestampsオプションがあれば有効にしてTS.Recentを覚える (RFC7323 3.2)
+func (c *Conn) negotiateTimestamps(seg *segment) {
+	ts, ok := seg.options.Timestamps()
+	c.tsEnabled = ok
+	if ok {
+		c.tsRecent = ts.Value
+		c.tsRecentAge = time.Now()
+	}
+}
+
+// addTimestampsOption は自分のTSvalと相手の最新のTSvalをつける
+func (c *Conn) addTimestampsOption(seg *segment) {
+	opt := TimestampsOption{Value: c.tsClock.now()}
+	// TSecrはACKを立てるときだけ意味を持つ
+	if seg.has(ACK) {
+		opt.EchoReply = c.tsRecent
+	}
+	seg.options = append(seg.options, NoOperationOption{}, NoOperationOption{}, opt)
+}
+
+// checkPAWS はタイムスタンプが付いていないセグメントや古い重複セグメントを捨てるかを判定する (RFC7323 5.3)
+func (c *Conn) checkPAWS(seg *segment) bool {
+	if !c.tsEnabled || seg.has(RST) {
+		return true
+	}
+	ts, ok := seg.options.Timestamps()
+	if !ok {
+		return false
+	}
+	// 長い間何も受け取っていなければTS.Recentは当てにならない
+	if time.Since(c.tsRecentAge) > pawsIdleTime {
+		c.tsRecent = ts.Value
+		c.tsRecentAge = time.Now()
+		return true
+	}
+	return !seqLT(ts.Value, c.tsRecent)
+}
+
+// updateTSRecent は受け入れたセグメントが最後に送ったACK以前から始まっていればTS.Recentを更新する (RFC7323 4.3)
+func (c *Conn) updateTSRecent(seg *segment) {
+	if !c.tsEnabled {
+		return
+	}
+	ts, ok := seg.options.Timestamps()
+	if !ok {
+		return
+	}
+	if seqGE(ts.Value, c.tsRecent) && seqLE(seg.seq, c.lastAckSent) {
+		c.tsRecent = ts.Value
+		c.tsRecentAge = time.Now()
+	}
+}
+
+// sampleTimestampRTT は新しいデータをACKしたセグメントのTSecrからRTTを計測する (RFC7323 4.1)。
+// エコーされた値は再送したセグメントでも送った時刻を正しく示すのでKarnのアルゴリズムは不要
+func (c *Conn) sampleTimestampRTT(seg *segment) {
+	ts, ok := seg.options.Timestamps()
+	if !ok || ts.EchoReply == 0 {
+		return
+	}
+	rtt := c.tsClock.now() - ts.EchoReply
+	// 送った覚えのない未来の値は無視する
+	if int32(rtt) < 0 {
+		return
+	}
+	c.rto.sample(time.Duration(rtt) * time.Millisecond)
+}
@@ -0,0 +1,84 @@
+package rfc9401
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"net/netip"
+	"sync"
+	"testing"
+)
+
+func TestSegmentSizeExcludesOptions(t *testing.T) {
+	var mu sync.Mutex
+	largest := 0
+	c, s := lossyStacks(t, func(seg segment) bool {
+		mu.Lock()
+		defer mu.Unlock()
+		if len(seg.data) > largest {
+			largest = len(seg.data)
+		}
+		return false
+	})
+	ln, err := s.ListenTCP(&net.TCPAddr{Port: 80})
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan []byte)
+	go sinkServer(ln, done)
+
+	conn, err := c.DialTCP(nil, &net.TCPAddr{IP: net.IP{192, 0, 2, 2}, Port: 80})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !conn.tsEnabled {
+		t.Fatal("timestamps are not negotiated")
+	}
+	payload := bytes.Repeat([]byte("z"), 100000)
+	conn.Write(payload)
+	conn.Close()
+	if got := <-done; !bytes.Equal(got, payload) {
+		t.Fatalf("received %d bytes, want %d", len(got), len(payload))
+	}
+
+	// オプションを含めたTCPのペイロードがMSSに収まる (RFC9293 3.7.1)
+	mu.Lock()
+	defer mu.Unlock()
+	if want := int(conn.sndMSS) - 12; largest != want {
+		t.Fatalf("largest segment carries %d bytes, want %d", largest, want)
+	}
+}
+
+func TestPAWS(t *testing.T) {
+	c, s := pipeStacks(t)
+	conn, srv := dialPipe(t, c, s)
+	if !conn.tsEnabled || !srv.tsEnabled {
+		t.Fatal("timestamps are not negotiated")
+	}
+	conn.Write([]byte("abc"))
+	if _, err := io.ReadFull(srv, make([]byte, 3)); err != nil {
+		t.Fatal(err)
+	}
+
+	// TS.Recentより古いタイムスタンプのセグメントは古い重複として捨てる
+	srv.mu.Lock()
+	old := segment{
+		srcPort: conn.localPort,
+		dstPort: 80,
+		seq:     srv.rcvNxt,
+		ack:     srv.sndNxt,
+		flags:   ACK | PSH,
+		window:  1000,
+		options: TCPOptions{TimestampsOption{Value: srv.tsRecent - 100}},
+		data:    []byte("zzz"),
+	}
+	rcvNxt := srv.rcvNxt
+	srv.mu.Unlock()
+	srv.handleSegment(netip.MustParseAddr("192.0.2.1"), old)
+
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if srv.rcvNxt != rcvNxt {
+		t.Fatal("old duplicate segment was accepted")
+	}
+}
@@ -0,0 +1,264 @@
+package rfc9401
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	// 受信バッファの大きさ。空きを受信ウィンドウとして広告する
+	receiveBufferSize = 256 * 1024
+	// まだ送っていないデータをためておける大きさ
+	sendBufferSize = 256 * 1024
+	// Window Scaleのシフト数の最大値 (RFC7323 2.3)
+	maxWindowShift = 14
+)
+
+// windowShiftFor はsizeを16bitのウィンドウで表すために必要なシフト数を返す
+func windowShiftFor(size int) uint8 {
+	var shift uint8
+	for shift < maxWindowShift && size > 0xffff<<shift {
+		shift++
+	}
+	return shift
+}
+
+// negotiateWindowScale は相手のSYNにWindow Scaleオプションがあればシフト数を決める。
+// 両方のSYNにオプションがある場合だけ有効になる (RFC7323 2.2)
+func (c *Conn) negotiateWindowScale(seg *segment) {
+	shift, ok := seg.options.WindowScale()
+	if !ok {
+		c.sndWndShift = 0
+		c.rcvWndShift = 0
+		c.wsEnabled = false
+		return
+	}
+	c.sndWndShift = shift
+	if c.sndWndShift > maxWindowShift {
+		c.sndWndShift = maxWindowShift
+	}
+	c.rcvWndShift = windowShiftFor(receiveBufferSize)
+	c.wsEnabled = true
+}
+
+// initSendWindow はSYNで受け取ったウィンドウをセットする。SYNのウィンドウはスケールしない
+func (c *Conn) initSendWindow(seg *segment) {
+	c.sndWnd = uint32(seg.window)
+	c.maxSndWnd = c.sndWnd
+	c.sndWl1 = seg.seq
+	c.sndWl2 = seg.ack
+}
+
+// updateSendWindow は新しいセグメントであれば相手の受信ウィンドウを更新する (RFC9293 3.10.7.4)
+func (c *Conn) updateSendWindow(seg *segment) {
+	if !seqLT(c.sndWl1, seg.seq) && !(c.sndWl1 == seg.seq && seqLE(c.sndWl2, seg.ack)) {
+		return
+	}
+	old := c.sndWnd
+	c.sndWnd = uint32(seg.window) << c.sndWndShift
+	c.sndWl1 = seg.seq
+	c.sndWl2 = seg.ack
+	if c.sndWnd > c.maxSndWnd {
+		c.maxSndWnd = c.sndWnd
+	}
+
+	// ゼロウィンドウが開いたらプローブで送った分を待たずに再送する
+	if old == 0 && c.sndWnd > 0 && len(c.rtxQueue) > 0 {
+		c.retransmitHead()
+	}
+}
+
+// sendWindow は相手の受信ウィンドウと輻輳ウィンドウの小さい方から、いま送れるデータの量を返す
+func (c *Conn) sendWindow() uint32 {
+	inFlight := c.sndNxt - c.sndUna
+	if c.sackRecovering() {
+		// SACKによる損失回復中はpipeで輻輳ウィンドウの余裕を見積もる (RFC6675 5 (C))
+		if inFlight >= c.sndWnd {
+			return 0
+		}
+		wnd := c.sndWnd - inFlight
+		if avail := c.sackWindow(); avail < wnd {
+			wnd = avail
+		}
+		return wnd
+	}
+
+	wnd := c.sndWnd
+	if cwnd := c.congestionWindow(); cwnd < wnd {
+		wnd = cwnd
+	}
+	if inFlight >= wnd {
+		return 0
+	}
+	return wnd - inFlight
+}
+
+// rcvWindow は相手に広告している受信ウィンドウのうちまだ埋まっていない大きさを返す
+func (c *Conn) rcvWindow() uint32 {
+	if seqLE(c.rcvAdv, c.rcvNxt) {
+		return 0
+	}
+	return c.rcvAdv - c.rcvNxt
+}
+
+// advertiseWindow は受信バッファの空きから広告するウィンドウを決める。
+// SWSを避けるため、右端はmin(バッファの半分, MSS)以上進むときだけ動かし、縮めることはしない (RFC9293 3.8.6.2.2)。
+// ウィンドウは16bitのフィールドをシフトして表せる大きさまでにする。Window Scaleを使わなければ0xffffまで
+func (c *Conn) advertiseWindow() uint32 {
+	free := receiveBufferSize - len(c.recvBuf)
+	if free < 0 {
+		free = 0
+	}
+	if limit := 0xffff << c.rcvWndShift; free > limit {
+		free = limit
+	}
+	// シフトで切り捨てられる端数は広告できないので右端に含めない
+	free &^= 1<<c.rcvWndShift - 1
+	threshold := uint32(receiveBufferSize / 2)
+	if threshold > defaultMSS {
+		threshold = defaultMSS
+	}
+	edge := c.rcvNxt + uint32(free)
+	if seqGE(edge, c.rcvAdv+threshold) || (seqGT(edge, c.rcvAdv) && len(c.recvBuf) == 0) {
+		c.rcvAdv = edge
+	}
+	return c.rcvWindow()
+}
+
+// updateReceiveWindow はアプリケーションがデータを読み出して受信ウィンドウが開いたら相手に知らせる
+func (c *Conn) updateReceiveWindow() {
+	if !c.state.synchronized() {
+		return
+	}
+	old := c.rcvAdv
+	if c.advertiseWindow(); c.rcvAdv != old {
+		c.sendAck()
+	}
+}
+
+// output は送信バッファのデータを相手のウィンドウに収まる分だけセグメントにして送る。
+// 送り終わってCloseされていればFINを送る
+func (c *Conn) output() {
+	for len(c.sndQueue) > 0 {
+		mss := c.segmentSize()
+		n := uint32(len(c.sndQueue))
+		if n > mss {
+			n = mss
+		}
+		if wnd := c.sendWindow(); n > wnd {
+			n = wnd
+		}
+		if n == 0 {
+			break
+		}
+		// SWSを避けるため、MSSに満たない小さなセグメントは
+		// 残りをすべて送れるときか相手の最大ウィンドウの半分以上になるときだけ送る (RFC9293 3.8.6.2.1)
+		if n < mss && n < uint32(len(c.sndQueue)) && n < c.maxSndWnd/2 {
+			break
+		}
+
+		if err := c.sendData(n); err != nil {
+			return
+		}
+	}
+
+	if c.finQueued && !c.finSent && len(c.sndQueue) == 0 {
+		// FINACKパケットを送信
+		if err := c.transmit(c.sndNxt, FIN|ACK, nil); err != nil {
+			c.err = fmt.Errorf("send fin err : %v", err)
+			return
+		}
+		c.sndNxt++
+		c.finSent = true
+		fmt.Println("Send FINACK packet")
+	}
+
+	// 相手のウィンドウが0で送るものがあるのにACK待ちがなければプローブを送るタイマをかける
+	if len(c.sndQueue) > 0 && len(c.rtxQueue) == 0 {
+		c.startPersistTimer()
+	} else {
+		c.stopPersistTimer()
+	}
+}
+
+func (c *Conn) startPersistTimer() {
+	if c.persistTimer != nil {
+		return
+	}
+	c.persistGeneration++
+	generation := c.persistGeneration
+	c.persistTimer = time.AfterFunc(c.rto.rto, func() {
+		c.onPersistTimeout(generation)
+	})
+}
+
+func (c *Conn) stopPersistTimer() {
+	if c.persistTimer != nil {
+		c.persistTimer.Stop()
+		c.persistTimer = nil
+	}
+}
+
+// onPersistTimeout はゼロウィンドウプローブとして1byteだけ送る。
+// 以降は再送タイマが間隔を倍にしながらプローブを送り直す (RFC9293 3.8.6.1)。
+// ウィンドウが開いていればSWS回避のオーバーライドとして送れる分を送る
+func (c *Conn) onPersistTimeout(generation uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if generation != c.persistGeneration || c.state == StateClosed {
+		return
+	}
+	c.persistTimer = nil
+	if len(c.sndQueue) == 0 || len(c.rtxQueue) > 0 {
+		return
+	}
+
+	n := c.sendWindow()
+	if mss := c.segmentSize(); n > mss {
+		n = mss
+	}
+	if n > uint32(len(c.sndQueue)) {
+		n = uint32(len(c.sndQueue))
+	}
+	if n == 0 {
+		n = 1
+	}
+	c.sendData(n)
+}
+
+// segmentSize は1つのセグメントで送れるデータの大きさを返す。
+// SND.MSSはオプションを含まないので、データのセグメントにつけるオプションの長さを引く (RFC9293 3.7.1)
+func (c *Conn) segmentSize() uint32 {
+	seg := segment{flags: ACK}
+	if c.tsEnabled {
+		c.addTimestampsOption(&seg)
+	}
+	c.addSACKOption(&seg)
+	options, err := seg.options.Marshal()
+	if err != nil || len(options) >= int(c.sndMSS) {
+		return uint32(c.sndMSS)
+	}
+	return uint32(int(c.sndMSS) - len(options))
+}
+
+// sendData は送信バッファの先頭からnbyteを1つのセグメントで送る。
+// 送信バッファが空になるときはPSHを立てる
+func (c *Conn) sendData(n uint32) error {
+	flags := uint8(ACK)
+	if n == uint32(len(c.sndQueue)) {
+		flags |= PSH
+	}
+	data := append([]byte(nil), c.sndQueue[:n]...)
+	if err := c.transmit(c.sndNxt, flags, data); err != nil {
+		c.err = fmt.Errorf("send data err : %v", err)
+		return c.err
+	}
+	c.sndNxt += n
+	c.sndQueue = c.sndQueue[n:]
+	if flags&PSH != 0 {
+		fmt.Println("Send PSHACK packet")
+	}
+	c.wakeup()
+	return nil
+}
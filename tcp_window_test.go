@@ -0,0 +1,79 @@
+package rfc9401
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestZeroWindow(t *testing.T) {
+	c, s := pipeStacks(t)
+	ln, err := s.ListenTCP(&net.TCPAddr{Port: 80})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(chan []byte)
+	go func() {
+		conn, err := ln.AcceptTCP()
+		if err != nil {
+			return
+		}
+		// 読まずにいて受信バッファを埋め、ウィンドウを0にする
+		time.Sleep(2500 * time.Millisecond)
+		b, _ := io.ReadAll(conn)
+		got <- b
+		conn.Close()
+	}()
+
+	conn, err := c.DialTCP(nil, &net.TCPAddr{IP: net.IP{192, 0, 2, 2}, Port: 80})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(30 * time.Second))
+	payload := make([]byte, 700000)
+	for i := range payload {
+		payload[i] = byte(i * 13)
+	}
+	if _, err := conn.Write(payload); err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if b := <-got; !bytes.Equal(b, payload) {
+		t.Fatalf("received %d bytes, want %d", len(b), len(payload))
+	}
+}
+
+func TestAdvertiseWindowFitsHeader(t *testing.T) {
+	a, _ := Pipe(netip.MustParseAddr("192.0.2.1"), netip.MustParseAddr("192.0.2.2"))
+	st := NewStack(a)
+	defer st.Close()
+
+	for _, shift := range []uint8{0, 1, 3} {
+		conn := newConn(st, netip.MustParseAddr("192.0.2.1"), 1)
+		conn.rcvWndShift = shift
+		conn.wsEnabled = shift != 0
+		conn.rcvNxt = 1000
+		conn.rcvAdv = 1000
+
+		wnd := conn.advertiseWindow()
+		if limit := uint32(0xffff) << shift; wnd > limit {
+			t.Fatalf("shift %d: window %d exceeds %d", shift, wnd, limit)
+		}
+		if wnd%(1<<shift) != 0 {
+			t.Fatalf("shift %d: window %d is truncated by the shift", shift, wnd)
+		}
+		if conn.rcvAdv != conn.rcvNxt+wnd {
+			t.Fatalf("shift %d: rcvAdv %d is beyond the advertised edge %d", shift, conn.rcvAdv, conn.rcvNxt+wnd)
+		}
+		// 広告した右端より先のデータは受け入れない
+		seg := segment{seq: conn.rcvAdv, data: []byte{0}}
+		if conn.acceptable(&seg) {
+			t.Fatalf("shift %d: accepted data beyond the advertised window", shift)
+		}
+	}
+}
@@ -0,0 +1,159 @@
+//go:build linux
+
+package rfc9401
+
+import (
+	"fmt"
+	"net/netip"
+	"os"
+	"strconv"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	// TUNのインターフェース名のデフォルト
+	defaultTUNName = "rfc9401tun0"
+	defaultTUNMTU  = 1500
+
+	// linux/if_tun.h
+	tunSetIff = 0x400454ca
+	iffTun    = 0x0001
+	iffNoPi   = 0x1000
+)
+
+// TUNConfig はTUNデバイスの設定
+type TUNConfig struct {
+	// Name はインターフェース名。空ならrfc9401tun0
+	Name string
+	// HostPrefix はカーネル側でインターフェースに割り当てるアドレスとサブネット。例えば10.9.0.1/24
+	HostPrefix netip.Prefix
+	// LocalAddr はStackが使うアドレス。HostPrefixのサブネットに含まれていること
+	LocalAddr netip.Addr
+	// Routes はサブネットの他にインターフェースへ向ける経路
+	Routes []netip.Prefix
+	// MTU は0なら1500
+	MTU int
+}
+
+// TUN はLinuxのTUNデバイスを使うPacketIO。
+// IPヘッダも自分で付けるので、カーネルのTCPはこのアドレスのセグメントに関わらない
+type TUN struct {
+	file *os.File
+	name string
+	addr netip.Addr
+	mtu  int
+
+	buf []byte
+	id  ipv4IDCounter
+}
+
+// OpenTUN はTUNデバイスを作り、アドレスと経路を設定して有効にする。root権限が必要
+func OpenTUN(config TUNConfig) (*TUN, error) {
+	if config.Name == "" {
+		config.Name = defaultTUNName
+	}
+	if config.MTU == 0 {
+		config.MTU = defaultTUNMTU
+	}
+	if len(config.Name) >= syscall.IFNAMSIZ {
+		return nil, fmt.Errorf("invalid tun name : %s", config.Name)
+	}
+	if !config.HostPrefix.Addr().Is4() || !config.LocalAddr.Is4() || !config.HostPrefix.Contains(config.LocalAddr) {
+		return nil, fmt.Errorf("local address %s is not in %s", config.LocalAddr, config.HostPrefix)
+	}
+
+	fd, err := syscall.Open("/dev/net/tun", syscall.O_RDWR|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, fmt.Errorf("open tun err : %v", err)
+	}
+	var ifr struct {
+		name  [syscall.IFNAMSIZ]byte
+		flags uint16
+		_     [22]byte
+	}
+	copy(ifr.name[:], config.Name)
+	ifr.flags = iffTun | iffNoPi
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), tunSetIff, uintptr(unsafe.Pointer(&ifr))); errno != 0 {
+		syscall.Close(fd)
+		return nil, fmt.Errorf("TUNSETIFF err : %v", errno)
+	}
+	// ノンブロッキングにしておくとCloseでReadが戻る
+	if err := syscall.SetNonblock(fd, true); err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+
+	tun := &TUN{
+		file: os.NewFile(uintptr(fd), "/dev/net/tun"),
+		name: config.Name,
+		addr: config.LocalAddr,
+		mtu:  config.MTU,
+		buf:  make([]byte, config.MTU),
+	}
+	commands := [][]string{
+		{"link", "set", "dev", config.Name, "mtu", strconv.Itoa(config.MTU)},
+		{"addr", "add", config.HostPrefix.String(), "dev", config.Name},
+		{"link", "set", "dev", config.Name, "up"},
+	}
+	for _, route := range config.Routes {
+		commands = append(commands, []string{"route", "add", route.String(), "dev", config.Name})
+	}
+	for _, args := range commands {
+		if err := runCommand(false, "", "ip", args...); err != nil {
+			tun.Close()
+			return nil, err
+		}
+	}
+
+	return tun, nil
+}
+
+// Name はインターフェース名を返す
+func (tun *TUN) Name() string {
+	return tun.name
+}
+
+// MTU はインターフェースのMTUを返す。StackはここからSYNで広告するMSSを決める
+func (tun *TUN) MTU() int {
+	return tun.mtu
+}
+
+// ReadPacket はLocalAddr宛てのTCPのIPパケットが届くまで読み、IPヘッダを外したTCPセグメントをbにコピーする
+func (tun *TUN) ReadPacket(b []byte) (int, netip.Addr, netip.Addr, error) {
+	for {
+		n, err := tun.file.Read(tun.buf)
+		if err != nil {
+			return 0, netip.Addr{}, netip.Addr{}, err
+		}
+		// IPv6のルータ要請やMLDなども届くが、IPv4のTCPでなければ黙って捨てる
+		ip, err := ParseIPv4Header(tun.buf[:n])
+		if err != nil {
+			continue
+		}
+		if ip.Protocol != IPProtocolTCP || ip.Dst != tun.addr {
+			continue
+		}
+		return copy(b, ip.Payload(tun.buf[:n])), ip.Src, ip.Dst, nil
+	}
+}
+
+// WritePacket はTCPセグメントbにIPヘッダを付けて書き込む
+func (tun *TUN) WritePacket(b []byte, src netip.Addr, dst netip.Addr) error {
+	ip := NewIPv4Header(src, dst, len(b), tun.id.next())
+	header, err := ip.Marshal()
+	if err != nil {
+		return err
+	}
+	_, err = tun.file.Write(append(header, b...))
+	return err
+}
+
+func (tun *TUN) LocalAddr() netip.Addr {
+	return tun.addr
+}
+
+// Close はデバイスを閉じる。インターフェースはカーネルが消す
+func (tun *TUN) Close() error {
+	return tun.file.Close()
+}
@@ -1,12 +1,9 @@
 package rfc9401
 
 import (
-	"bytes"
 	"encoding/binary"
-	"fmt"
 	"math/rand"
-	"strconv"
-	"strings"
+	"rfc9401/checksum"
 	"time"
 )
 
@@ -30,42 +27,25 @@ func byteToUint32(b []byte) uint32 {
 	return binary.BigEndian.Uint32(b)
 }
 
-func sumByteArr(packet []byte) (sum uint) {
-	for i, _ := range packet {
-		if i%2 == 0 {
-			sum += uint(byteToUint16(packet[i:]))
-		}
-	}
-	return sum
+func calcChecksum(packet []byte) []byte {
+	return uint16ToByte(checksum.Checksum(0, packet))
 }
 
-func calcChecksum(packet []byte) []byte {
-	// まず16ビット毎に足す
-	sum := sumByteArr(packet)
-	// あふれた桁を足す
-	sum = (sum & 0xffff) + sum>>16
-	// 論理否定を取った値をbyteにして返す
-	return uint16ToByte(uint16(sum ^ 0xffff))
+// シーケンス番号は32bitで一周するので差分の符号で大小を比べる
+func seqLT(a, b uint32) bool {
+	return int32(a-b) < 0
 }
 
-func addAckNumber(ack []byte, add uint32) []byte {
-	intack := byteToUint32(ack)
-	intack += add
-	return uint32ToByte(intack)
+func seqLE(a, b uint32) bool {
+	return int32(a-b) <= 0
 }
 
-func ipv4ToByte(ipv4 string) []byte {
-	var b bytes.Buffer
-	str := strings.Split(ipv4, ".")
-	for _, v := range str {
-		i, _ := strconv.Atoi(v)
-		b.Write([]byte{byte(i)})
-	}
-	return b.Bytes()
+func seqGT(a, b uint32) bool {
+	return int32(a-b) > 0
 }
 
-func ipv4ByteToString(ipv4 []byte) string {
-	return fmt.Sprintf("%d.%d.%d.%d", ipv4[0], ipv4[1], ipv4[2], ipv4[3])
+func seqGE(a, b uint32) bool {
+	return int32(a-b) >= 0
 }
 
 func getRandomClientPort() int {